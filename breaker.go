@@ -0,0 +1,23 @@
+package hedgedhttp
+
+import "net/http"
+
+// CircuitBreaker disables hedging, e.g. when the backend error rate is high,
+// so hedged requests don't amplify the load on a failing backend.
+type CircuitBreaker interface {
+	// AllowHedge is called before every hedged request (attempt >= 1),
+	// if it returns false no more requests are started for the round trip.
+	AllowHedge() bool
+
+	// RecordResult is called when a request is finished, success is false for errors and 5xx responses.
+	// Requests canceled because the round trip has finished are not recorded.
+	RecordResult(success bool)
+}
+
+// recordResult reports the request outcome to the circuit breaker, if there is one.
+func (ht *hedgedTransport) recordResult(outcome AttemptOutcome, resp *http.Response) {
+	if ht.breaker == nil || outcome == AttemptCanceled {
+		return
+	}
+	ht.breaker.RecordResult(resp != nil && resp.StatusCode < 500)
+}
@@ -0,0 +1,55 @@
+package hedgedhttp
+
+import (
+	"net/http"
+	"time"
+)
+
+// Builder builds a hedged http.Client with chainable methods,
+// it's an alternative to NewClientWithOptions with the same behaviour.
+//
+//	client, err := hedgedhttp.NewBuilder().
+//		Timeout(10 * time.Millisecond).
+//		Upto(3).
+//		Build()
+type Builder struct {
+	client *http.Client
+	opts   []Option
+}
+
+// NewBuilder returns a new Builder.
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Timeout is the same as WithTimeout.
+func (b *Builder) Timeout(timeout time.Duration) *Builder {
+	return b.With(WithTimeout(timeout))
+}
+
+// Upto is the same as WithUpto.
+func (b *Builder) Upto(upto int) *Builder {
+	return b.With(WithUpto(upto))
+}
+
+// DelayFunc is the same as WithDelayFunc.
+func (b *Builder) DelayFunc(fn func(attempt int) time.Duration) *Builder {
+	return b.With(WithDelayFunc(fn))
+}
+
+// Client sets the client to use, see NewClientWithOptions.
+func (b *Builder) Client(client *http.Client) *Builder {
+	b.client = client
+	return b
+}
+
+// With adds options which have no builder method.
+func (b *Builder) With(opts ...Option) *Builder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Build validates the configuration and returns a new client, see NewClientWithOptions.
+func (b *Builder) Build() (*http.Client, error) {
+	return NewClientWithOptions(b.client, b.opts...)
+}
@@ -0,0 +1,59 @@
+package hedgedhttp
+
+import "net/http"
+
+// Callbacks given in options are called through these wrappers: a panicking callback
+// doesn't crash the round trip, the panic is logged and the default behavior is used instead.
+
+// recoverCallback recovers a panic of the named callback, must be deferred.
+func (ht *hedgedTransport) recoverCallback(name string) {
+	if r := recover(); r != nil && ht.logger != nil {
+		ht.logger.Logf("hedgedhttp: %s panicked: %v", name, r)
+	}
+}
+
+// validateResponse returns Accept if the validator panics.
+func (ht *hedgedTransport) validateResponse(resp *http.Response) (result ValidationResult) {
+	result = Accept
+	defer ht.recoverCallback("response validator")
+	return ht.validator(resp)
+}
+
+// selectIndex returns -1 if the selector panics, so the default response is selected.
+func (ht *hedgedTransport) selectIndex(candidates []*http.Response) (idx int) {
+	idx = -1
+	defer ht.recoverCallback("response selector")
+	return ht.selector(candidates)
+}
+
+// decorate returns the request as is if the decorator panics.
+func (ht *hedgedTransport) decorate(req *http.Request, attempt int) (decorated *http.Request) {
+	decorated = req
+	defer ht.recoverCallback("request decorator")
+	if r := ht.decorator(req, attempt); r != nil {
+		return r
+	}
+	return req
+}
+
+// notifyHedge ignores a panic of the callback, the request is sent anyway.
+func (ht *hedgedTransport) notifyHedge(req *http.Request, attempt int) {
+	defer ht.recoverCallback("hedge callback")
+	ht.onHedge(req, attempt)
+}
+
+// notifyCancel ignores a panic of the callback.
+func (ht *hedgedTransport) notifyCancel(attempt int) {
+	defer ht.recoverCallback("attempt cancel callback")
+	ht.onAttemptCancel(attempt)
+}
+
+// isRetryable reports true, like without a classifier, if the classifier panics.
+func (ht *hedgedTransport) isRetryable(err error) (retryable bool) {
+	if ht.classifier == nil {
+		return true
+	}
+	retryable = true
+	defer ht.recoverCallback("error classifier")
+	return ht.classifier(err)
+}
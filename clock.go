@@ -0,0 +1,33 @@
+package hedgedhttp
+
+import "time"
+
+// Clock provides the time for scheduling of hedged requests, see WithClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by Clock, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// since is time.Since for the given clock.
+func since(clock Clock, t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
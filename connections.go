@@ -0,0 +1,107 @@
+package hedgedhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// separateTransports returns n transports with their own connection pools,
+// the first one is rt itself. Reports false if rt is not an *http.Transport.
+func separateTransports(rt http.RoundTripper, n int) ([]http.RoundTripper, bool) {
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, false
+	}
+	rts := make([]http.RoundTripper, n)
+	rts[0] = rt
+	for i := 1; i < n; i++ {
+		rts[i] = t.Clone()
+	}
+	return rts, true
+}
+
+// dialerTransports replaces the dialer of rts (see separateTransports) with the dialer of every request.
+func dialerTransports(rt http.RoundTripper, rts []http.RoundTripper, dialer func(attempt int) func(ctx context.Context, network, addr string) (net.Conn, error)) ([]http.RoundTripper, bool) {
+	return overrideTransports(rt, rts, func(attempt int) func(t *http.Transport) {
+		dial := dialer(attempt)
+		if dial == nil {
+			return nil
+		}
+		return func(t *http.Transport) { t.DialContext = dial }
+	})
+}
+
+// proxyTransports replaces the proxy of rts (see separateTransports) with the proxy of every request.
+func proxyTransports(rt http.RoundTripper, rts []http.RoundTripper, proxy func(attempt int) func(*http.Request) (*url.URL, error)) ([]http.RoundTripper, bool) {
+	return overrideTransports(rt, rts, func(attempt int) func(t *http.Transport) {
+		p := proxy(attempt)
+		if p == nil {
+			return nil
+		}
+		return func(t *http.Transport) { t.Proxy = p }
+	})
+}
+
+// overrideTransports applies the override of every request to rts, nil override keeps the transport as is.
+// A transport shared with other requests is cloned first. Reports false if rt is not an *http.Transport.
+func overrideTransports(rt http.RoundTripper, rts []http.RoundTripper, override func(attempt int) func(t *http.Transport)) ([]http.RoundTripper, bool) {
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, false
+	}
+	for i := range rts {
+		if rts[i] == nil {
+			rts[i] = rt
+		}
+		set := override(i)
+		if set == nil {
+			continue
+		}
+		if rts[i] == rt {
+			rts[i] = t.Clone()
+		}
+		set(rts[i].(*http.Transport))
+	}
+	return rts, true
+}
+
+// roundTripper returns the transport which is used for the given request.
+func (ht *hedgedTransport) roundTripper(attempt int) http.RoundTripper {
+	if ht.clientForAttempt != nil {
+		if client := ht.clientForAttempt(attempt); client != nil {
+			if client.Transport == nil {
+				return http.DefaultTransport
+			}
+			return client.Transport
+		}
+	}
+	if len(ht.attemptRTs) == 0 {
+		return ht.rt
+	}
+	return ht.attemptRTs[attempt%len(ht.attemptRTs)]
+}
+
+// Prewarm sends a HEAD request to the given URL through the underlying transport (without hedging),
+// so a connection and TLS session are established and kept in the transport pool for the next requests.
+// With WithSeparateConnections a connection is established for every transport.
+// It's best called at startup for known hosts, any response status is fine.
+func (ht *hedgedTransport) Prewarm(ctx context.Context, url string) error {
+	rts := ht.attemptRTs
+	if len(rts) == 0 {
+		rts = []http.RoundTripper{ht.rt}
+	}
+	for _, rt := range rts {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		drainBody(resp.Body, ht.drainLimit)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package hedgedhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnTrace describes how a request has obtained its connection.
+type ConnTrace struct {
+	// Reused reports whether the connection was taken from the pool.
+	Reused bool
+	// WasIdle reports whether the reused connection was idle.
+	WasIdle bool
+	// DNS is the duration of the DNS lookup, zero if there was none.
+	DNS time.Duration
+	// TLSHandshake is the duration of the TLS handshake, zero if there was none.
+	TLSHandshake time.Duration
+	// GotConn is the time from the start of the request until the connection was obtained.
+	GotConn time.Duration
+}
+
+type connTraceKey struct{}
+
+// AttemptConnTrace returns the connection trace of the request which has produced the response.
+// The trace is recorded only if WithOnAttemptComplete is used, it's meant to be called from the hook,
+// but works for the returned response as well.
+func AttemptConnTrace(resp *http.Response) (ConnTrace, bool) {
+	if resp == nil || resp.Request == nil {
+		return ConnTrace{}, false
+	}
+	rec, ok := resp.Request.Context().Value(connTraceKey{}).(*connRecorder)
+	if !ok {
+		return ConnTrace{}, false
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.trace, true
+}
+
+// connRecorder records ConnTrace, hooks can be called concurrently by the transport.
+type connRecorder struct {
+	mu       sync.Mutex
+	start    time.Time
+	dnsStart time.Time
+	tlsStart time.Time
+	trace    ConnTrace
+}
+
+// withConnTrace returns a context which records ConnTrace of the request,
+// a trace already present in ctx is still called.
+func withConnTrace(ctx context.Context) context.Context {
+	rec := &connRecorder{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rec.mu.Lock()
+			rec.dnsStart = time.Now()
+			rec.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rec.mu.Lock()
+			rec.trace.DNS = time.Since(rec.dnsStart)
+			rec.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			rec.mu.Lock()
+			rec.tlsStart = time.Now()
+			rec.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rec.mu.Lock()
+			rec.trace.TLSHandshake = time.Since(rec.tlsStart)
+			rec.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rec.mu.Lock()
+			rec.trace.Reused, rec.trace.WasIdle = info.Reused, info.WasIdle
+			rec.trace.GotConn = time.Since(rec.start)
+			rec.mu.Unlock()
+		},
+	}
+	// WithClientTrace composes the hooks with the trace which is already in ctx
+	ctx = httptrace.WithClientTrace(ctx, trace)
+	return context.WithValue(ctx, connTraceKey{}, rec)
+}
+
+// traceSignal is closed once when the request reaches some point, see WithHedgeAfterWriteRequest
+// and WithProgressDetector.
+type traceSignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newTraceSignal() *traceSignal {
+	return &traceSignal{ch: make(chan struct{})}
+}
+
+func (s *traceSignal) close() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+// fired reports whether the signal is closed.
+func (s *traceSignal) fired() bool {
+	select {
+	case <-s.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// withWroteSignal returns a context which closes s when the request is written,
+// a trace already present in ctx is still called.
+func withWroteSignal(ctx context.Context, s *traceSignal) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { s.close() },
+	})
+}
+
+// withProgressSignal returns a context which closes s when the first response byte is received,
+// including informational responses like 100 Continue. A trace already present in ctx is still called.
+func withProgressSignal(ctx context.Context, s *traceSignal) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: s.close,
+	})
+}
@@ -0,0 +1,123 @@
+package hedgedhttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	requestTimeoutKey struct{}
+	requestUptoKey    struct{}
+	attemptIndexKey   struct{}
+	roundTripInfoKey  struct{}
+	clientNameKey     struct{}
+)
+
+// WithRequestTimeout returns a context which overrides the delay between hedged requests
+// for requests made with it. The override takes precedence over all delay options of the client,
+// jitter is still applied. Negative timeout is treated as zero.
+func WithRequestTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout < 0 {
+		timeout = 0
+	}
+	return context.WithValue(ctx, requestTimeoutKey{}, timeout)
+}
+
+// WithRequestUpto returns a context which overrides the maximum number of requests
+// started for round trips made with it. Values less than 1 are treated as 1.
+func WithRequestUpto(ctx context.Context, upto int) context.Context {
+	if upto < 1 {
+		upto = 1
+	}
+	return context.WithValue(ctx, requestUptoKey{}, upto)
+}
+
+// WithoutHedging returns a context which disables hedging for requests made with it,
+// exactly one request is sent regardless of upto and WithImmediateFanout.
+// It's the same as WithRequestUpto(ctx, 1).
+func WithoutHedging(ctx context.Context) context.Context {
+	return WithRequestUpto(ctx, 1)
+}
+
+func requestTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return timeout, ok
+}
+
+func requestUpto(ctx context.Context) (int, bool) {
+	upto, ok := ctx.Value(requestUptoKey{}).(int)
+	return upto, ok
+}
+
+// AttemptIndex returns the zero-based index of the request which has produced the response,
+// e.g. 0 if the first request has won. The index is carried by resp.Request context,
+// so it's only meaningful for responses returned by hedged client or round tripper.
+func AttemptIndex(resp *http.Response) (int, bool) {
+	if resp == nil || resp.Request == nil {
+		return 0, false
+	}
+	idx, ok := resp.Request.Context().Value(attemptIndexKey{}).(int)
+	return idx, ok
+}
+
+// ClientName returns the name of the client set with WithName, or empty string if it's not named.
+// The name is carried by the context given to Tracer.Start and by contexts of hedged requests.
+func ClientName(ctx context.Context) string {
+	name, _ := ctx.Value(clientNameKey{}).(string)
+	return name
+}
+
+// RoundTripsForResponse returns the number of requests sent for the round trip
+// which has returned the response, it's 1 if the first request has won.
+// Like AttemptIndex it's only meaningful for responses returned by hedged client or round tripper,
+// zero is returned for other responses.
+func RoundTripsForResponse(resp *http.Response) int {
+	info := responseInfo(resp)
+	if info == nil {
+		return 0
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.roundTrips
+}
+
+// ScheduleForResponse returns the delays waited before hedged requests 1..n-1 of the round trip
+// which has returned the response, as computed by the scheduler, including jitter and adaptive delay.
+// It's like HedgePlan.Delays, but only for requests which were actually sent. Like AttemptIndex
+// it's only meaningful for responses returned by hedged client or round tripper, nil is returned
+// for other responses.
+func ScheduleForResponse(resp *http.Response) []time.Duration {
+	info := responseInfo(resp)
+	if info == nil {
+		return nil
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return append([]time.Duration(nil), info.delays...)
+}
+
+// roundTripInfo describes requests sent for a round trip, it's carried by the request context.
+type roundTripInfo struct {
+	mu         sync.Mutex
+	roundTrips int
+	delays     []time.Duration
+}
+
+func (info *roundTripInfo) addAttempt(attempt int, delay time.Duration) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.roundTrips++
+	if attempt > 0 {
+		info.delays = append(info.delays, delay)
+	}
+}
+
+func responseInfo(resp *http.Response) *roundTripInfo {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	info, _ := resp.Request.Context().Value(roundTripInfoKey{}).(*roundTripInfo)
+	return info
+}
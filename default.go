@@ -0,0 +1,40 @@
+package hedgedhttp
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultClientTimeout = 50 * time.Millisecond
+	defaultClientUpto    = 3
+)
+
+var (
+	defaultOnce   sync.Once
+	defaultClient atomic.Value // *http.Client
+)
+
+// Default returns a shared hedged client, like http.DefaultClient. Unless SetDefault is called,
+// the client is created on first use with NewClient(50*time.Millisecond, 3, nil).
+// It's safe to call Default concurrently.
+func Default() *http.Client {
+	defaultOnce.Do(func() {
+		if defaultClient.Load() == nil {
+			defaultClient.Store(NewClient(defaultClientTimeout, defaultClientUpto, nil))
+		}
+	})
+	return defaultClient.Load().(*http.Client)
+}
+
+// SetDefault replaces the client returned by Default, nil restores the client with default settings.
+// Call SetDefault before the first use of Default (e.g. in init or main), otherwise callers
+// which have already got the previous client keep using it.
+func SetDefault(client *http.Client) {
+	if client == nil {
+		client = NewClient(defaultClientTimeout, defaultClientUpto, nil)
+	}
+	defaultClient.Store(client)
+}
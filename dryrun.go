@@ -0,0 +1,62 @@
+package hedgedhttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// HedgePlan describes hedged requests which would be sent for a round trip in dry-run mode.
+type HedgePlan struct {
+	// Delays between consecutive requests, Delays[i] is the delay before attempt i+1.
+	Delays []time.Duration
+
+	// Attempts is the predicted number of requests, assuming no hedged request is faster
+	// than the first one: every request started before the first one has finished is counted.
+	Attempts int
+
+	// Latency of the first request which was actually sent.
+	Latency time.Duration
+}
+
+// dryRunTrip sends only the first request and reports the plan of hedged requests.
+func (ht *hedgedTransport) dryRunTrip(req *http.Request, upto int) (*http.Response, error) {
+	plan := HedgePlan{Delays: ht.schedule(req.Context(), upto)}
+
+	start := time.Now()
+	g := newHedgeGroup(ht, req, 1)
+	resp, err := g.run()
+	g.finish(resp, err)
+	plan.Latency = time.Since(start)
+	plan.Attempts = predictAttempts(plan.Delays, plan.Latency)
+
+	ht.dryRun(plan)
+	return resp, err
+}
+
+// predictAttempts returns the number of requests started before the first one has finished.
+func predictAttempts(delays []time.Duration, latency time.Duration) int {
+	attempts := 1
+	var elapsed time.Duration
+	for _, d := range delays {
+		elapsed += d
+		if elapsed >= latency {
+			break
+		}
+		attempts++
+	}
+	return attempts
+}
+
+// schedule returns delays before attempts 1..upto-1.
+func (ht *hedgedTransport) schedule(ctx context.Context, upto int) []time.Duration {
+	if upto <= 1 {
+		return nil
+	}
+	delays := make([]time.Duration, upto-1)
+	var prev time.Duration
+	for i := range delays {
+		delays[i] = ht.delay(ctx, i+1, &prev)
+	}
+	return delays
+}
@@ -0,0 +1,233 @@
+package hedgedhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// HedgedError is an error type to track multiple errors. This is used to
+// accumulate errors of all hedged requests and return them as a single "error".
+// Insiper by https://github.com/hashicorp/go-multierror
+type HedgedError struct {
+	Errors        []error
+	ErrorFormatFn ErrorFormatFunc
+
+	attempts []AttemptError
+}
+
+func (e *HedgedError) Error() string {
+	fn := e.ErrorFormatFn
+	if fn == nil {
+		fn = listFormatFunc
+	}
+	return fn(e.Errors)
+}
+
+func (e *HedgedError) String() string {
+	return fmt.Sprintf("*%#v", e.Errors)
+}
+
+// Unwrap returns all accumulated errors, so errors.Is and errors.As
+// match any of them.
+func (e *HedgedError) Unwrap() []error {
+	return e.Errors
+}
+
+// Timeout reports whether all errors are timeouts, like net.Error.
+// An error is a timeout if it or an error it wraps has Timeout method which returns true.
+func (e *HedgedError) Timeout() bool {
+	return e.all(func(err error) bool {
+		var t interface{ Timeout() bool }
+		return errors.As(err, &t) && t.Timeout()
+	})
+}
+
+// Temporary reports whether all errors are temporary, like net.Error.
+// An error is temporary if it or an error it wraps has Temporary method which returns true.
+func (e *HedgedError) Temporary() bool {
+	return e.all(func(err error) bool {
+		var t interface{ Temporary() bool }
+		return errors.As(err, &t) && t.Temporary()
+	})
+}
+
+// all reports whether there are errors and all of them match.
+func (e *HedgedError) all(match func(error) bool) bool {
+	for _, err := range e.Errors {
+		if !match(err) {
+			return false
+		}
+	}
+	return len(e.Errors) > 0
+}
+
+// Attempts returns the failure of every request in order of arrival, see AttemptError.
+// If the error is not returned by the transport, Errors are listed with Index -1.
+func (e *HedgedError) Attempts() []AttemptError {
+	return attemptErrors(e.attempts, e.Errors)
+}
+
+// ErrorOrNil returns an error if there are some.
+func (e *HedgedError) ErrorOrNil() error {
+	switch {
+	case e == nil || len(e.Errors) == 0:
+		return nil
+	default:
+		return e
+	}
+}
+
+// ErrorAggregation defines which error is returned when all hedged requests have failed.
+type ErrorAggregation int
+
+const (
+	// AggregateAll returns a *HedgedError with errors of all requests. This is the default.
+	AggregateAll ErrorAggregation = iota
+
+	// FirstError returns the error of the request which has failed first.
+	FirstError
+
+	// LastError returns the error of the request which has failed last.
+	LastError
+)
+
+// aggregate returns a single error for the errors in order of arrival.
+// Attempts are failures of all requests for HedgedError.Attempts.
+func (a ErrorAggregation) aggregate(errs []error, attempts []AttemptError) error {
+	switch {
+	case len(errs) == 0 || a == AggregateAll:
+		return &HedgedError{Errors: errs, attempts: attempts}
+	case a == FirstError:
+		return errs[0]
+	default:
+		return errs[len(errs)-1]
+	}
+}
+
+// ErrLatencyBudgetExceeded is matched by errors.Is for the error returned
+// when the latency budget is exceeded, see WithLatencyBudget.
+var ErrLatencyBudgetExceeded = errors.New("hedgedhttp: latency budget exceeded")
+
+// LatencyBudgetError is returned when no response has arrived within the latency budget.
+type LatencyBudgetError struct {
+	Budget time.Duration
+	Errors []error // errors of requests which have failed before the budget expired
+
+	attempts []AttemptError
+}
+
+func (e *LatencyBudgetError) Error() string {
+	msg := fmt.Sprintf("hedgedhttp: latency budget %v exceeded", e.Budget)
+	if len(e.Errors) == 0 {
+		return msg
+	}
+	return msg + ": " + listFormatFunc(e.Errors)
+}
+
+// Is reports whether target is ErrLatencyBudgetExceeded.
+func (e *LatencyBudgetError) Is(target error) bool {
+	return target == ErrLatencyBudgetExceeded
+}
+
+// Unwrap returns errors of failed requests, like HedgedError.Unwrap.
+func (e *LatencyBudgetError) Unwrap() []error {
+	return e.Errors
+}
+
+// Attempts returns failures of requests which have finished before the budget expired, like HedgedError.Attempts.
+func (e *LatencyBudgetError) Attempts() []AttemptError {
+	return attemptErrors(e.attempts, e.Errors)
+}
+
+// Categories of AttemptError.
+const (
+	CategoryDial           = "dial"            // connection cannot be established, including DNS errors
+	CategoryTLS            = "tls"             // TLS handshake or certificate verification has failed
+	CategoryTimeout        = "timeout"         // request has timed out
+	CategoryCanceled       = "canceled"        // request has been canceled
+	CategoryStatusRejected = "status-rejected" // response is rejected by the validator or the selection policy
+	CategoryOther          = "other"
+)
+
+// AttemptError is a failure of a single request of a round trip.
+type AttemptError struct {
+	Index      int   // zero-based attempt index
+	Err        error // nil for a rejected response
+	StatusCode int   // status of a rejected response, zero for errors
+	Category   string
+}
+
+// attemptErrors returns failures with their categories, errs are used if there are no failures.
+func attemptErrors(failures []AttemptError, errs []error) []AttemptError {
+	if failures == nil {
+		failures = make([]AttemptError, len(errs))
+		for i, err := range errs {
+			failures[i] = AttemptError{Index: -1, Err: err}
+		}
+	}
+	res := make([]AttemptError, len(failures))
+	for i, f := range failures {
+		f.Category = CategoryStatusRejected
+		if f.Err != nil {
+			f.Category = errorCategory(f.Err)
+		}
+		res[i] = f
+	}
+	return res
+}
+
+// errorCategory returns the category of a request error, see AttemptError.
+func errorCategory(err error) string {
+	var (
+		opErr        *net.OpError
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		hostnameErr  x509.HostnameError
+	)
+	switch {
+	case errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial":
+		return CategoryDial
+	case errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &hostnameErr):
+		return CategoryTLS
+	// handshake and alert errors of crypto/tls have no exported types before Go 1.21
+	case strings.HasPrefix(err.Error(), "tls: ") || strings.Contains(err.Error(), ": tls: "):
+		return CategoryTLS
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return CategoryTimeout
+	case errors.Is(err, context.Canceled):
+		return CategoryCanceled
+	default:
+		return CategoryOther
+	}
+}
+
+// MultiError is an alias for HedgedError.
+//
+// Deprecated: use HedgedError instead.
+type MultiError = HedgedError
+
+// ErrorFormatFunc is called by HedgedError to return the list of errors as a string.
+type ErrorFormatFunc func([]error) string
+
+func listFormatFunc(es []error) string {
+	if len(es) == 1 {
+		return fmt.Sprintf("1 error occurred:\n\t* %s\n\n", es[0])
+	}
+
+	points := make([]string, len(es))
+	for i, err := range es {
+		points[i] = fmt.Sprintf("* %s", err)
+	}
+
+	return fmt.Sprintf("%d errors occurred:\n\t%s\n\n", len(es), strings.Join(points, "\n\t"))
+}
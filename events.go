@@ -0,0 +1,120 @@
+package hedgedhttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// EventType is a type of a hedged request lifecycle event.
+type EventType int
+
+const (
+	// EventStarted is sent when a request is started.
+	EventStarted EventType = iota
+
+	// EventCompleted is sent when a request has returned a response, even if it's discarded.
+	EventCompleted
+
+	// EventErrored is sent when a request has returned an error.
+	EventErrored
+
+	// EventCanceled is sent when a request is canceled because the round trip has finished.
+	EventCanceled
+
+	// EventWon is sent after EventCompleted for the request whose response is returned.
+	EventWon
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStarted:
+		return "started"
+	case EventCompleted:
+		return "completed"
+	case EventErrored:
+		return "errored"
+	case EventCanceled:
+		return "canceled"
+	case EventWon:
+		return "won"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a lifecycle event of a single request of a hedged round trip.
+type Event struct {
+	Type    EventType
+	Attempt int
+
+	// Latency is the time since the request was started, zero for EventStarted.
+	Latency time.Duration
+
+	// Err is the request error for EventErrored and EventCanceled.
+	Err error
+}
+
+type eventTracer struct {
+	ch    chan<- Event
+	clock Clock
+}
+
+func (t eventTracer) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	return ctx, t
+}
+
+func (t eventTracer) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, AttemptSpan) {
+	t.send(Event{Type: EventStarted, Attempt: attempt})
+	return ctx, &eventAttempt{t: t, attempt: attempt, start: t.clock.Now()}
+}
+
+func (t eventTracer) End(winner int, err error) {}
+
+// withEventClock sets the clock of event tracers, they are created by options
+// before the clock is known.
+func withEventClock(tracer Tracer, clock Clock) Tracer {
+	switch t := tracer.(type) {
+	case eventTracer:
+		t.clock = clock
+		return t
+	case multiTracer:
+		m := make(multiTracer, len(t))
+		for i, tt := range t {
+			m[i] = withEventClock(tt, clock)
+		}
+		return m
+	}
+	return tracer
+}
+
+// send doesn't block, the event is dropped if the channel is full.
+func (t eventTracer) send(e Event) {
+	select {
+	case t.ch <- e:
+	default:
+	}
+}
+
+type eventAttempt struct {
+	t       eventTracer
+	attempt int
+	start   time.Time
+}
+
+func (a *eventAttempt) End(outcome AttemptOutcome, resp *http.Response, err error) {
+	e := Event{Attempt: a.attempt, Latency: since(a.t.clock, a.start), Err: err}
+	switch outcome {
+	case AttemptWon:
+		e.Type = EventCompleted
+		a.t.send(e)
+		e.Type = EventWon
+	case AttemptLost:
+		e.Type = EventCompleted
+	case AttemptFailed:
+		e.Type = EventErrored
+	case AttemptCanceled:
+		e.Type = EventCanceled
+	}
+	a.t.send(e)
+}
@@ -1,3 +1,3 @@
 module github.com/cristalhq/hedgedhttp
 
-go 1.16
+go 1.20
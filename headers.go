@@ -0,0 +1,47 @@
+package hedgedhttp
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setHedgeHeaders sets the headers configured with WithHedgeHeader and WithHedgeGroupHeader.
+func (g *hedgeGroup) setHedgeHeaders(req *http.Request, attempt int) {
+	if g.ht.hedgeHeader != "" {
+		req.Header.Set(g.ht.hedgeHeader, strconv.Itoa(attempt))
+	}
+	if g.ht.groupHeader != "" {
+		req.Header.Set(g.ht.groupHeader, g.groupID)
+	}
+}
+
+type groupIDKey struct{}
+
+// withGroupID sets the group ID for the round trip, so the tracer can report the same ID.
+func (g *hedgeGroup) withGroupID() {
+	g.groupID = newGroupID()
+	g.ctx = context.WithValue(g.ctx, groupIDKey{}, g.groupID)
+}
+
+// groupID returns the group ID of the round trip, see WithHedgeGroupHeader.
+func groupID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(groupIDKey{}).(string)
+	return id, ok
+}
+
+// newGroupID returns a random (version 4) UUID.
+func newGroupID() string {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		binary.LittleEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+		binary.LittleEndian.PutUint64(b[8:], uint64(secureSeed()))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
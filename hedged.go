@@ -1,10 +1,18 @@
 package hedgedhttp
 
 import (
+	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,14 +21,71 @@ const infiniteTimeout = 30 * 24 * time.Hour // domain specific infinite
 // NewClient returns a new http.Client which implements hedged requests pattern.
 // Given Client starts a new request after a timeout from previous request.
 // Starts no more than upto requests.
+//
+// Upto less than 1 is treated as 1 and negative timeout is treated as zero,
+// use NewClientWithOptions to get an error for invalid values instead.
 func NewClient(timeout time.Duration, upto int, client *http.Client) *http.Client {
+	if upto < 1 {
+		upto = 1
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	cfg := defaultConfig()
+	cfg.timeout = timeout
+	cfg.upto = upto
+	return newClient(cfg, client)
+}
+
+// NewClientWithOptions returns a new http.Client which implements hedged requests pattern.
+// Same as NewClient but configured with the given options.
+func NewClientWithOptions(client *http.Client, opts ...Option) (*http.Client, error) {
+	cfg, err := newConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(cfg, client), nil
+}
+
+// NewClientAndStats returns a new http.Client which implements hedged requests pattern
+// And Stats object that can be queried to obtain client's metrics.
+// Given Client starts a new request after a timeout from previous request.
+// Starts no more than upto requests.
+func NewClientAndStats(timeout time.Duration, upto int, client *http.Client) (*http.Client, *Stats, error) {
+	stats := &Stats{}
+	client, err := NewClientWithOptions(client, WithTimeout(timeout), WithUpto(upto), WithStats(stats))
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, stats, nil
+}
+
+// Wrap returns a shallow copy of the client with its Transport replaced by a hedged round tripper,
+// which wraps the original transport (http.DefaultTransport if it's nil).
+// Unlike NewClient the given client is not modified, Jar, CheckRedirect and Timeout are kept intact.
+// Note that the client Timeout bounds the whole round trip including all hedged requests.
+// If client is nil, a zero http.Client is used.
+func Wrap(client *http.Client, opts ...Option) (*http.Client, error) {
+	cfg, err := newConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &http.Client{}
+	if client != nil {
+		*wrapped = *client
+	}
+	wrapped.Transport = newHedgedTransport(cfg, wrapped.Transport)
+	return wrapped, nil
+}
+
+func newClient(cfg *config, client *http.Client) *http.Client {
 	if client == nil {
 		client = &http.Client{
 			Timeout: 5 * time.Second,
 		}
 	}
 
-	client.Transport = NewRoundTripper(timeout, upto, client.Transport)
+	client.Transport = newHedgedTransport(cfg, client.Transport)
 
 	return client
 }
@@ -28,118 +93,1401 @@ func NewClient(timeout time.Duration, upto int, client *http.Client) *http.Clien
 // NewRoundTripper returns a new http.RoundTripper which implements hedged requests pattern.
 // Given RoundTripper starts a new request after a timeout from previous request.
 // Starts no more than upto requests.
-func NewRoundTripper(timeout time.Duration, upto int, rt http.RoundTripper) http.RoundTripper {
+//
+// Request body is replayed for every hedged request with req.GetBody,
+// if it's not set the body is buffered in memory (see WithMaxBufferedBody).
+//
+// A response is selected as soon as its headers are received, i.e. when rt.RoundTrip returns,
+// the body of the returned response is streamed as is while other requests are canceled.
+// Only WithQuorum reads response bodies before returning.
+//
+// A panic in a callback of the response validator, response selector, request decorator,
+// error classifier or WithOnHedge is recovered and logged (see WithLogger),
+// the round trip goes on as if the callback wasn't set.
+//
+// If rt is nil, http.DefaultTransport is used.
+//
+// Returned RoundTripper implements Shutdown(ctx context.Context) error
+// to cancel all requests in flight and wait for them to finish,
+// and Prewarm(ctx context.Context, url string) error to establish connections in advance.
+func NewRoundTripper(timeout time.Duration, upto int, rt http.RoundTripper) (http.RoundTripper, error) {
+	cfg, err := newConfig(WithTimeout(timeout), WithUpto(upto))
+	if err != nil {
+		return nil, err
+	}
+	return newHedgedTransport(cfg, rt), nil
+}
+
+func newHedgedTransport(cfg *config, rt http.RoundTripper) *hedgedTransport {
 	if rt == nil {
 		rt = http.DefaultTransport
 	}
+	c := *cfg
+	if c.stats == nil {
+		c.stats = &Stats{}
+	}
+	if c.clock == nil {
+		c.clock = realClock{}
+	}
+	c.tracer = withEventClock(c.tracer, c.clock)
+	if c.adaptiveWindow > 0 {
+		c.stats.firstAttemptLatency.init(c.adaptiveWindow)
+	}
+	if c.name != "" && c.logger != nil {
+		c.logger = namedLogger{l: c.logger, prefix: "[" + c.name + "] "}
+	}
+	source := c.randSource
+	switch {
+	case source != nil:
+	case c.seedSet:
+		source = rand.NewSource(c.jitterSeed)
+	default:
+		source = rand.NewSource(secureSeed())
+	}
 	hedged := &hedgedTransport{
-		rt:      rt,
-		timeout: timeout,
-		upto:    upto,
+		config: c,
+		rt:     rt,
+		rand:   newLockedRand(source),
+		done:   make(chan struct{}),
+	}
+	if c.separateConns && c.upto > 1 {
+		hedged.attemptRTs, _ = separateTransports(rt, c.upto)
 	}
+	if c.dialerForAttempt != nil {
+		rts := hedged.attemptRTs
+		if len(rts) == 0 {
+			rts = make([]http.RoundTripper, c.upto)
+		}
+		hedged.attemptRTs, _ = dialerTransports(rt, rts, c.dialerForAttempt)
+	}
+	if c.proxyForAttempt != nil {
+		rts := hedged.attemptRTs
+		if len(rts) == 0 {
+			rts = make([]http.RoundTripper, c.upto)
+		}
+		hedged.attemptRTs, _ = proxyTransports(rt, rts, c.proxyForAttempt)
+	}
+	hedged.direct = hedged.canSendDirectly()
 	return hedged
 }
 
 type hedgedTransport struct {
-	rt      http.RoundTripper
-	timeout time.Duration
-	upto    int
+	config
+
+	rt   http.RoundTripper
+	rand *lockedRand
+
+	// attemptRTs are clones of rt used by WithSeparateConnections and WithDialerForAttempt
+	attemptRTs []http.RoundTripper
+
+	// direct reports whether a single request can be sent without a hedge group
+	direct bool
+
+	// drainer keeps discarded responses waiting to be drained
+	drainer drainer
+
+	// mu guards closed, so wg.Add doesn't race with wg.Wait in Shutdown
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// cancels are canceled by Shutdown, for requests which aren't watched by a hedge group
+	cancels shutdownCancels
+}
+
+// isClosed reports whether Shutdown is called.
+func (ht *hedgedTransport) isClosed() bool {
+	select {
+	case <-ht.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownCancels keeps cancel functions of requests in flight, which are called by Shutdown.
+type shutdownCancels struct {
+	mu      sync.Mutex
+	closed  bool
+	nextID  uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+// add registers cancel and returns its ID for remove, cancel is called at once after cancelAll.
+func (s *shutdownCancels) add(cancel context.CancelFunc) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		cancel()
+		return 0
+	}
+	if s.cancels == nil {
+		s.cancels = make(map[uint64]context.CancelFunc)
+	}
+	s.nextID++
+	s.cancels[s.nextID] = cancel
+	return s.nextID
+}
+
+func (s *shutdownCancels) remove(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cancels, id)
+}
+
+func (s *shutdownCancels) cancelAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for id, cancel := range s.cancels {
+		cancel()
+		delete(s.cancels, id)
+	}
+}
+
+// ErrShutdown is returned by the transport after Shutdown is called.
+var ErrShutdown = errors.New("hedgedhttp: transport is shut down")
+
+// acquire registers a new round trip, reports false if the transport is shut down.
+func (ht *hedgedTransport) acquire() bool {
+	ht.mu.RLock()
+	defer ht.mu.RUnlock()
+	if ht.closed {
+		return false
+	}
+	ht.wg.Add(1)
+	return true
+}
+
+// Shutdown stops accepting new requests, cancels all requests in flight and
+// waits until they are finished or the given context is done.
+// Draining of discarded response bodies is aborted, see WithDrainLimit.
+func (ht *hedgedTransport) Shutdown(ctx context.Context) error {
+	ht.mu.Lock()
+	if !ht.closed {
+		ht.closed = true
+		close(ht.done)
+	}
+	ht.mu.Unlock()
+	ht.cancels.cancelAll()
+
+	drained := make(chan struct{})
+	go func() {
+		ht.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (ht *hedgedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	mainCtx := req.Context()
+	if !ht.acquire() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrShutdown
+	}
+	ht.stats.requestedRoundTrips.inc()
 
-	timeout := ht.timeout
-	if timeout == 0 {
-		timeout = time.Nanosecond // smallest possible timeout if not set
+	upto := ht.upto
+	if n, ok := requestUpto(req.Context()); ok {
+		upto = n
+	}
+	if ht.backupHost != "" && upto > 2 {
+		upto = 2 // primary and backup only
+	}
+	if !ht.isHedgeable(req.Method) {
+		upto = 1
+	}
+	if ht.hedgeableLenSet && req.ContentLength > ht.maxHedgeableLen {
+		upto = 1 // too large to be sent more than once
+	}
+	if upto > 1 && req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		var buffered bool
+		var err error
+		req, buffered, err = bufferBody(req, ht.maxBufferedBody)
+		if err != nil {
+			ht.wg.Done()
+			return nil, err
+		}
+		if !buffered {
+			upto = 1 // body cannot be replayed, so it cannot be hedged
+		}
+	}
+	if ht.hedgeableLenSet && (hasUnknownLength(req) || req.ContentLength > ht.maxHedgeableLen) {
+		upto = 1 // size of a buffered body is known only now
 	}
 
-	errOverall := &MultiError{}
-	resultCh := make(chan indexedResp, ht.upto)
-	errorCh := make(chan error, ht.upto)
+	if ht.dryRun != nil {
+		return ht.dryRunTrip(req, upto)
+	}
+	if upto == 1 && ht.direct {
+		return ht.directTrip(req)
+	}
 
-	resultIdx := -1
-	cancels := make([]func(), ht.upto)
+	g := newHedgeGroup(ht, req, upto)
+	resp, err := g.run()
+	g.finish(resp, err)
+	return resp, err
+}
 
-	defer runInPool(func() {
-		for i, cancel := range cancels {
-			if i != resultIdx && cancel != nil {
-				cancel()
-			}
+// canSendDirectly reports whether the request of a round trip with a single request can be sent
+// without the hedge group machinery: no option needs a hedge group for a single request,
+// e.g. a callback, tracer, selector or per attempt customization. Options which aren't checked
+// either don't affect the first request, are decided before the round trip, or are supported by directTrip.
+func (ht *hedgedTransport) canSendDirectly() bool {
+	c := &ht.config
+	// response handling
+	if c.validator != nil || c.triggerOnInvalid || c.selector != nil || c.quorum > 1 {
+		return false
+	}
+	// per attempt customization and routing
+	if c.decorator != nil || c.contextTagger != nil || c.dialerForAttempt != nil ||
+		c.proxyForAttempt != nil || c.clientForAttempt != nil || c.hedgeHeader != "" || c.groupHeader != "" ||
+		len(c.hosts) > 0 || len(c.weightedHosts) > 0 || len(c.targetURLs) > 0 || c.backupHost != "" {
+		return false
+	}
+	// limits of the attempt
+	if c.breaker != nil || c.rateLimiter != nil || c.perAttemptTimeout > 0 || c.latencyBudget > 0 {
+		return false
+	}
+	// observers
+	return c.onAttemptComplete == nil && c.onAttemptCancel == nil && c.tracer == nil && c.logger == nil
+}
+
+// directTrip sends the only request of the round trip on the caller goroutine.
+func (ht *hedgedTransport) directTrip(req *http.Request) (*http.Response, error) {
+	defer ht.wg.Done()
+
+	ctx := context.WithValue(req.Context(), attemptIndexKey{}, 0)
+	ctx = context.WithValue(ctx, roundTripInfoKey{}, &roundTripInfo{roundTrips: 1})
+	ctx, cancel := context.WithCancel(ctx)
+	id := ht.cancels.add(cancel)
+	subReq := req.WithContext(ctx)
+
+	ht.stats.actualRoundTrips.inc()
+	ht.stats.inFlight.inc()
+	start := ht.clock.Now()
+	resp, err := ht.rt.RoundTrip(subReq)
+	ht.stats.inFlight.dec()
+	ht.cancels.remove(id)
+
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			ht.stats.failedAttempts.inc()
 		}
-	})
+		cancel()
+		switch {
+		case req.Context().Err() != nil:
+			return nil, req.Context().Err()
+		case ht.isClosed():
+			return nil, ErrShutdown
+		case !ht.isRetryable(err):
+			return nil, err
+		}
+		return nil, ht.errorAggregation.aggregate([]error{err}, []AttemptError{{Index: 0, Err: err}})
+	}
+	ht.stats.statusCounts.inc(resp.StatusCode)
+	ht.stats.firstAttemptLatency.add(since(ht.clock, start))
+	if resp.Request == nil {
+		resp.Request = subReq // keeps the attempt index for AttemptIndex
+	}
+	return resp, nil
+}
 
-	for sent := 0; len(errOverall.Errors) < ht.upto; sent++ {
-		if sent < ht.upto {
-			idx := sent
-			subReq, cancel := reqWithCtx(req, mainCtx)
-			cancels[idx] = cancel
+// hedgeGroup is a state of a single hedged round trip.
+type hedgeGroup struct {
+	ht   *hedgedTransport
+	req  *http.Request
+	ctx  context.Context
+	upto int
+	span Span
 
-			runInPool(func() {
-				resp, err := ht.rt.RoundTrip(subReq)
-				if err != nil {
-					errorCh <- err
-				} else {
-					resultCh <- indexedResp{idx, resp}
-				}
-			})
+	resultCh chan indexedResp
+	errorCh  chan indexedResp
+
+	// latencyTimer expires when the latency budget is exceeded, see WithLatencyBudget
+	latencyTimer Timer
+
+	start     time.Time
+	attempts  []attempt
+	sent      int
+	received  int
+	winner    int
+	info      *roundTripInfo
+	prevDelay time.Duration
+	groupID   string
+
+	// failedHosts have returned an error, they are skipped by host rotation
+	failedHosts []string
+
+	// failures are errors and rejected responses for HedgedError.Attempts
+	failures []AttemptError
+
+	// held is the best response which doesn't finish the round trip,
+	// returned only if there is nothing better
+	held candidate
+
+	// votes are buffered responses waiting for a quorum
+	votes []vote
+
+	// completed are responses passed to the response selector
+	completed []candidate
+}
+
+// attempt is a state of a single request of the hedge group.
+type attempt struct {
+	cancel func()
+	delay  time.Duration
+	span   AttemptSpan
+	wrote  *traceSignal
+	host   string // see WithHostRotation
+
+	// progress is closed when the request starts receiving a response, it's nil when
+	// the result is received, see WithProgressDetector and WithHedgeOnHeaderTimeout
+	progress *traceSignal
+}
+
+// groupPool reuses hedge groups with their channels, a group is put back
+// only when all its requests have reported their results.
+var groupPool sync.Pool
+
+func newHedgeGroup(ht *hedgedTransport, req *http.Request, upto int) *hedgeGroup {
+	g, _ := groupPool.Get().(*hedgeGroup)
+	if g == nil || cap(g.resultCh) < upto {
+		g = &hedgeGroup{
+			resultCh: make(chan indexedResp, upto),
+			errorCh:  make(chan indexedResp, upto),
+			attempts: make([]attempt, 0, upto),
 		}
+	}
+	*g = hedgeGroup{
+		ht:       ht,
+		req:      req,
+		ctx:      req.Context(),
+		upto:     upto,
+		start:    ht.clock.Now(),
+		resultCh: g.resultCh,
+		errorCh:  g.errorCh,
+		attempts: g.attempts[:upto],
+		winner:   -1,
+	}
+	// info is not a part of the group, it's used after the group is released
+	g.info = &roundTripInfo{}
+	g.ctx = context.WithValue(g.ctx, roundTripInfoKey{}, g.info)
+	if ht.groupHeader != "" {
+		g.withGroupID()
+	}
+	if ht.name != "" {
+		g.ctx = context.WithValue(g.ctx, clientNameKey{}, ht.name)
+	}
+	if ht.tracer != nil {
+		g.ctx, g.span = ht.tracer.Start(g.ctx, req)
+	}
+	if ht.latencyBudget > 0 {
+		g.latencyTimer = ht.clock.NewTimer(ht.latencyBudget)
+	}
+	return g
+}
+
+// release puts the group back to the pool, it must not be used after that.
+func (g *hedgeGroup) release() {
+	for i := range g.attempts {
+		g.attempts[i] = attempt{}
+	}
+	*g = hedgeGroup{
+		resultCh: g.resultCh,
+		errorCh:  g.errorCh,
+		attempts: g.attempts[:0],
+	}
+	groupPool.Put(g)
+}
 
-		// all request sent - effectively disabling timeout between requests
-		if sent == ht.upto {
-			timeout = infiniteTimeout
+func (g *hedgeGroup) run() (*http.Response, error) {
+	ht := g.ht
+	var errs []error
+
+	maxInFlight := g.upto
+	if ht.maxConcurrency > 0 && ht.maxConcurrency < g.upto {
+		maxInFlight = ht.maxConcurrency
+	}
+
+	var delay time.Duration // first request is sent immediately
+	for finished := 0; finished < g.upto; {
+		if g.sent > 0 && g.sent < g.upto && (!ht.hasBudget(g.ctx) || g.budgetExpired()) {
+			g.upto = g.sent // not enough time left for other requests
+			continue
+		}
+
+		paused := g.inProgress() // a request is slow but working
+		for !paused && g.sent < g.upto && g.sent-finished < maxInFlight {
+			if g.sent > 0 && ht.breaker != nil && !ht.breaker.AllowHedge() {
+				g.upto = g.sent // hedging is disabled by the circuit breaker
+				break
+			}
+			g.launch(delay)
+			if !ht.immediateFanout {
+				break
+			}
+		}
+
+		// all request sent or no free slots - effectively disabling timeout between requests
+		timeout := infiniteTimeout
+		if !paused && g.sent < g.upto && g.sent-finished < maxInFlight && ht.hedgeOnTimer() {
+			timeout = ht.delay(g.ctx, g.sent, &g.prevDelay)
+			delay = timeout
+		}
+		var latencyC <-chan time.Time
+		if g.latencyTimer != nil {
+			latencyC = g.latencyTimer.C()
+		}
+		var wrote <-chan struct{}
+		if timeout != infiniteTimeout && ht.hedgeAfterWrite {
+			wrote = g.attempts[g.sent-1].wrote.ch // timer starts when the previous request is written
+		}
+		res, ok, err := waitResult(g.ctx, ht.done, g.req.Cancel, latencyC, wrote, g.resultCh, g.errorCh, ht.clock, timeout)
+		if ok {
+			g.received++
+			g.attempts[res.Index].progress = nil
 		}
-		resp, err := waitResult(mainCtx, resultCh, errorCh, timeout)
 
 		switch {
-		case resp.Resp != nil:
-			resultIdx = resp.Index
-			return resp.Resp, nil
-		case mainCtx.Err() != nil:
-			return nil, mainCtx.Err()
+		case ok && res.Resp != nil:
+			if ht.respectRetryAfter && hasRetryAfter(res.Resp) || ht.hasStopHeader(res.Resp) {
+				g.upto = g.sent // backend asks to back off, don't pile on more requests
+			}
+			c := ht.newCandidate(res)
+			if c.stop {
+				g.winner = res.Index
+				return res.Resp, nil
+			}
+			if ht.selector != nil || ht.policy == PolicyWaitAll {
+				finished++
+				g.completed = append(g.completed, c)
+				if c.rank == rankBest && ht.selectorMode == SelectOnFirstReady && ht.policy != PolicyWaitAll {
+					return g.selectResponse(), nil
+				}
+				continue
+			}
+			if c.rank == rankBest && ht.quorum > 1 {
+				won, err := g.vote(res)
+				if won {
+					return g.votes[len(g.votes)-1].resp(), nil
+				}
+				if err != nil {
+					errs = append(errs, err)
+					g.failures = append(g.failures, AttemptError{Index: res.Index, Err: err})
+				}
+				finished++
+				continue
+			}
+			if c.rank == rankBest {
+				if ht.policy == PolicyBestStatus {
+					res = g.lowestReady(res)
+				}
+				g.winner = res.Index
+				return res.Resp, nil
+			}
+			finished++
+			if c.rank == rankRejected {
+				g.failures = append(g.failures, AttemptError{Index: res.Index, StatusCode: res.Resp.StatusCode})
+			}
+			var loser candidate
+			g.held, loser = pickCandidate(g.held, c)
+			g.discard(loser.indexedResp)
+		case ok:
+			g.endAttempt(res.Index, AttemptFailed, nil, res.Err)
+			switch {
+			case g.ctx.Err() != nil:
+				return nil, g.ctx.Err()
+			case !isGetBodyError(res.Err) && !ht.isRetryable(res.Err):
+				// a failed body replay affects only this request, others can still succeed
+				return nil, res.Err
+			}
+			finished++
+			errs = append(errs, res.Err)
+			g.failures = append(g.failures, AttemptError{Index: res.Index, Err: res.Err})
+			if len(ht.hosts) > 0 && !isGetBodyError(res.Err) {
+				g.hostFailed(g.attempts[res.Index].host)
+				if !g.hasHealthyHost() {
+					g.upto = g.sent // every host has already failed
+				}
+			}
+		case err == ErrLatencyBudgetExceeded:
+			return nil, &LatencyBudgetError{Budget: ht.latencyBudget, Errors: errs, attempts: g.failures}
 		case err != nil:
-			errOverall.Errors = append(errOverall.Errors, err)
+			return nil, err
 		}
 	}
 
+	if len(g.completed) > 0 {
+		return g.selectResponse(), nil
+	}
+	if v, ok := g.bestVote(); ok {
+		g.winner = v.Index
+		return v.resp(), nil
+	}
+	if g.held.Resp != nil {
+		g.winner = g.held.Index
+		return g.held.Resp, nil
+	}
+
 	// all request have returned errors
-	return nil, errOverall
+	return nil, ht.errorAggregation.aggregate(errs, g.failures)
+}
+
+// pickHost returns the host of the attempt in round-robin order, skipping hosts which have failed.
+func (g *hedgeGroup) pickHost(attempt int) string {
+	hosts := g.ht.hosts
+	for i := 0; i < len(hosts); i++ {
+		host := hosts[(attempt+i)%len(hosts)]
+		if !g.isFailedHost(host) {
+			return host
+		}
+	}
+	return hosts[attempt%len(hosts)]
+}
+
+func (g *hedgeGroup) hasHealthyHost() bool {
+	for _, host := range g.ht.hosts {
+		if !g.isFailedHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *hedgeGroup) hostFailed(host string) {
+	if !g.isFailedHost(host) {
+		g.failedHosts = append(g.failedHosts, host)
+	}
+}
+
+func (g *hedgeGroup) isFailedHost(host string) bool {
+	for _, h := range g.failedHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// lowestReady returns the response of the lowest attempt among res and the best responses
+// which have already arrived, so a tie between simultaneous responses doesn't depend on goroutine scheduling.
+func (g *hedgeGroup) lowestReady(res indexedResp) indexedResp {
+	for {
+		select {
+		case other := <-g.resultCh:
+			g.received++
+			if other.Index < res.Index && g.ht.newCandidate(other).rank == rankBest {
+				res, other = other, res
+			}
+			g.discard(other)
+		default:
+			return res
+		}
+	}
+}
+
+// hedgeOnTimer reports whether requests are started after a delay,
+// otherwise they are started only when previous requests have finished.
+func (ht *hedgedTransport) hedgeOnTimer() bool {
+	return !ht.triggerOnInvalid || len(ht.delayOpts) > 0
+}
+
+// inProgress reports whether a request has started receiving a response and has no result yet,
+// so no more requests are started until its result is received.
+func (g *hedgeGroup) inProgress() bool {
+	if !g.ht.progressDetector && !g.ht.hedgeOnHeaders {
+		return false
+	}
+	for i := 0; i < g.sent; i++ {
+		if p := g.attempts[i].progress; p != nil && p.fired() {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetExpired reports whether the total budget for starting requests has elapsed.
+func (g *hedgeGroup) budgetExpired() bool {
+	return g.ht.totalBudget > 0 && since(g.ht.clock, g.start) >= g.ht.totalBudget
+}
+
+// launch sends the next request in background, delay is the time waited since the previous request.
+func (g *hedgeGroup) launch(delay time.Duration) {
+	ht := g.ht
+	idx := g.sent
+	g.sent++
+
+	ctx := context.WithValue(g.ctx, attemptIndexKey{}, idx)
+	if ht.contextTagger != nil {
+		if tagged := ht.contextTagger(ctx, idx); tagged != nil {
+			ctx = tagged
+		}
+	}
+	var cancel context.CancelFunc
+	attemptTimeout := ht.perAttemptTimeout
+	if idx == 1 && ht.backupHost != "" {
+		attemptTimeout = ht.backupTimeout
+	}
+	if attemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, attemptTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	a := &g.attempts[idx]
+	a.cancel, a.delay = cancel, delay
+	if ht.logger != nil {
+		ht.logger.Logf("hedgedhttp: attempt %d started after %v", idx, delay)
+	}
+	if g.span != nil {
+		ctx, a.span = g.span.StartAttempt(ctx, idx, delay)
+	}
+	if ht.onAttemptComplete != nil {
+		ctx = withConnTrace(ctx)
+	}
+	var wrote *traceSignal
+	if ht.hedgeAfterWrite {
+		wrote = newTraceSignal()
+		a.wrote = wrote
+		ctx = withWroteSignal(ctx, wrote)
+	}
+	if idx == 0 && ht.progressDetector || ht.hedgeOnHeaders {
+		a.progress = newTraceSignal()
+		ctx = withProgressSignal(ctx, a.progress)
+	}
+	subReq := reqWithCtx(g.req, ctx, ht.needsClone())
+	if len(ht.hosts) > 0 {
+		a.host = g.pickHost(idx)
+		subReq.URL.Host = a.host
+		subReq.Host = a.host
+	}
+	g.setHedgeHeaders(subReq, idx)
+	ht.stats.actualRoundTrips.inc()
+	ht.stats.inFlight.inc()
+	g.info.addAttempt(idx, delay)
+
+	runInPool(func() {
+		// every request must report exactly one result, even on panic,
+		// otherwise its concurrency slot is never released,
+		// a response received before the panic is discarded, so it's not leaked
+		var resp *http.Response
+		defer func() {
+			if r := recover(); r != nil {
+				if resp != nil {
+					drainBody(resp.Body, ht.drainLimit)
+				}
+				g.report(g.errorCh, indexedResp{Index: idx, Err: fmt.Errorf("hedgedhttp: request panicked: %v", r)})
+			}
+		}()
+
+		subReq, err := ht.prepareRequest(subReq, idx)
+		if err != nil {
+			g.report(g.errorCh, indexedResp{Index: idx, Err: err})
+			return
+		}
+
+		if ht.rateLimiter != nil {
+			if err := ht.rateLimiter.Wait(ctx); err != nil {
+				g.report(g.errorCh, indexedResp{Index: idx, Err: err})
+				return
+			}
+		}
+
+		if idx > 0 && ht.onHedge != nil {
+			ht.notifyHedge(subReq, idx)
+		}
+
+		start := ht.clock.Now()
+		resp, err = ht.roundTripper(idx).RoundTrip(subReq)
+		if wrote != nil {
+			wrote.close() // the request has finished, even if it wasn't written
+		}
+		if ht.onAttemptComplete != nil {
+			hookErr := err
+			if err != nil && ctx.Err() != nil {
+				hookErr = ctx.Err()
+			}
+			ht.onAttemptComplete(idx, since(ht.clock, start), resp, hookErr)
+		}
+		if err != nil {
+			if ctx.Err() != context.Canceled {
+				ht.stats.failedAttempts.inc()
+			}
+			g.report(g.errorCh, indexedResp{Index: idx, Err: err})
+			return
+		}
+		ht.stats.statusCounts.inc(resp.StatusCode)
+		if idx == 0 {
+			ht.stats.firstAttemptLatency.add(since(ht.clock, start))
+		}
+		if resp.Request == nil {
+			resp.Request = subReq // keeps the attempt index for AttemptIndex
+		}
+		g.report(g.resultCh, indexedResp{Index: idx, Resp: resp})
+	})
+}
+
+// report sends the result of a request, the request is not in flight after that.
+func (g *hedgeGroup) report(ch chan indexedResp, res indexedResp) {
+	g.ht.stats.inFlight.dec()
+	ch <- res
+}
+
+// discard drains and closes the response, its request is canceled only after that,
+// so the connection can be reused.
+func (g *hedgeGroup) discard(res indexedResp) {
+	if res.Resp == nil {
+		return
+	}
+	g.endAttempt(res.Index, AttemptLost, res.Resp, nil)
+	a := &g.attempts[res.Index]
+	cancel := a.cancel
+	a.cancel = nil
+	g.ht.discardResponse(res.Resp, cancel)
+}
+
+// endAttempt reports the attempt outcome to the logger, the circuit breaker, the cancel callback and the span.
+func (g *hedgeGroup) endAttempt(idx int, outcome AttemptOutcome, resp *http.Response, err error) {
+	if g.ht.logger != nil {
+		logAttempt(g.ht.logger, idx, outcome, resp, err)
+	}
+	g.ht.recordResult(outcome, resp)
+	if outcome != AttemptWon && g.ht.onAttemptCancel != nil {
+		g.ht.notifyCancel(idx)
+	}
+	a := &g.attempts[idx]
+	if a.span != nil {
+		a.span.End(outcome, resp, err)
+		a.span = nil
+	}
+}
+
+// finish cancels all requests except the winner and releases their resources in background.
+func (g *hedgeGroup) finish(resp *http.Response, err error) {
+	ht := g.ht
+	if g.latencyTimer != nil {
+		g.latencyTimer.Stop()
+	}
+	if g.held.Resp != nil && g.held.Index != g.winner {
+		g.discard(g.held.indexedResp)
+	}
+	for _, v := range g.votes {
+		if v.Index != g.winner {
+			g.discard(v.indexedResp)
+		}
+	}
+	for _, c := range g.completed {
+		if c.Index != g.winner {
+			g.discard(c.indexedResp)
+		}
+	}
+	if g.winner >= 0 {
+		g.endAttempt(g.winner, AttemptWon, resp, nil)
+	}
+	// requests in flight are canceled after they are observed (see WithRegretMetric)
+	// or after the grace period (see WithLoserGracePeriod)
+	observe, rank := false, rankBest
+	if ht.regret != nil && resp != nil && g.sent > g.received {
+		rank = statusRank(resp.StatusCode)
+		observe = rank > rankBest
+	}
+	wait := observe || ht.loserGrace > 0 && resp != nil && g.sent > g.received
+	if !wait {
+		g.countCanceled()
+	}
+	if g.ht.logger != nil && err != nil {
+		g.ht.logger.Logf("hedgedhttp: round trip failed after %d attempts: %v", g.sent, err)
+	}
+	if g.span != nil {
+		g.span.End(g.winner, err)
+	}
+
+	pending := g.sent - g.received
+	cleanup := func() {
+		defer ht.wg.Done()
+
+		if wait {
+			window := ht.loserGrace
+			if observe {
+				window = g.regretWindow(window)
+			}
+			pending = g.awaitPending(window, rank, pending)
+			g.countCanceled()
+		}
+		for i, a := range g.attempts {
+			if i != g.winner && a.cancel != nil {
+				a.cancel()
+			}
+		}
+		// wait for requests in flight, so their responses are not leaked
+		for ; pending > 0; pending-- {
+			select {
+			case res := <-g.resultCh:
+				g.endAttempt(res.Index, AttemptCanceled, res.Resp, nil)
+				ht.drainResponse(res.Resp)
+			case res := <-g.errorCh:
+				g.endAttempt(res.Index, AttemptCanceled, nil, res.Err)
+			}
+		}
+		g.release()
+	}
+	// nothing to wait for, so there is no reason to occupy another goroutine
+	if pending == 0 {
+		cleanup()
+		return
+	}
+	runInPool(cleanup)
+}
+
+// countCanceled counts requests in flight except the winner, which are about to be canceled.
+func (g *hedgeGroup) countCanceled() {
+	for i, a := range g.attempts {
+		if i != g.winner && a.cancel != nil {
+			g.ht.stats.canceledSubRequests.inc()
+		}
+	}
+}
+
+// regretWindow returns how long requests in flight are observed by WithRegretMetric:
+// as long as the round trip has taken within the remaining total budget, but at least min.
+func (g *hedgeGroup) regretWindow(min time.Duration) time.Duration {
+	ht := g.ht
+	window := since(ht.clock, g.start)
+	if ht.totalBudget > 0 && ht.totalBudget-window < window {
+		window = ht.totalBudget - window
+	}
+	if window < min {
+		return min
+	}
+	return window
+}
+
+// awaitPending waits for requests in flight at most for the window, their responses are discarded.
+// Responses with a better status rank than the returned one are counted, see WithRegretMetric.
+// Returns the number of requests still in flight.
+func (g *hedgeGroup) awaitPending(window time.Duration, rank, pending int) int {
+	ht := g.ht
+	if window <= 0 {
+		return pending
+	}
+	timer := ht.clock.NewTimer(window)
+	defer timer.Stop()
+
+	for ; pending > 0; pending-- {
+		select {
+		case res := <-g.resultCh:
+			if ht.regret != nil && statusRank(res.Resp.StatusCode) < rank {
+				ht.regret.regret.inc()
+			}
+			g.discard(res)
+		case res := <-g.errorCh:
+			g.endAttempt(res.Index, AttemptFailed, nil, res.Err)
+			if a := &g.attempts[res.Index]; a.cancel != nil {
+				a.cancel()
+				a.cancel = nil
+			}
+		case <-timer.C():
+			return pending
+		case <-g.req.Context().Done():
+			return pending
+		case <-ht.done:
+			return pending
+		}
+	}
+	return 0
+}
+
+// getBodyError is returned when the request body cannot be replayed for a hedged request.
+type getBodyError struct {
+	err error
+}
+
+func (e *getBodyError) Error() string {
+	return "hedgedhttp: cannot replay request body: " + e.err.Error()
+}
+
+func (e *getBodyError) Unwrap() error { return e.err }
+
+func isGetBodyError(err error) bool {
+	var e *getBodyError
+	return errors.As(err, &e)
+}
+
+const (
+	rankBest     = 0
+	rankRejected = math.MaxInt32
+)
+
+// candidate is a response with its rank, lower rank is better.
+type candidate struct {
+	indexedResp
+	rank int
+	stop bool // finishes the round trip: rejected by the validator with RejectStop or a redirect, see WithRedirectPropagation
+}
+
+func (ht *hedgedTransport) newCandidate(resp indexedResp) candidate {
+	c := candidate{indexedResp: resp, rank: rankBest}
+	result := Accept
+	if ht.validator != nil {
+		result = ht.validateResponse(resp.Resp)
+	}
+	switch {
+	case result == RejectStop:
+		c.rank, c.stop = rankRejected, true
+	case result != Accept:
+		c.rank = rankRejected
+	case ht.redirects && isRedirect(resp.Resp):
+		c.stop = true
+	case ht.policy == PolicyBestStatus:
+		c.rank = statusRank(resp.Resp.StatusCode)
+	case ht.policy == PolicyFirstSuccess && !ht.isSuccess(resp.Resp.StatusCode):
+		c.rank = rankRejected
+	}
+	return c
+}
+
+// isRedirect reports whether the response is a redirect which is followed by http.Client.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	default:
+		return false
+	}
+}
+
+// isSuccess reports whether the status code satisfies PolicyFirstSuccess.
+func (ht *hedgedTransport) isSuccess(code int) bool {
+	if ht.successStatuses == nil {
+		return code >= 200 && code < 300
+	}
+	for _, c := range ht.successStatuses {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// pickCandidate returns the better and the worse candidates.
+// Among equally ranked candidates the lowest attempt is preferred, among rejected ones the last one.
+func pickCandidate(held, c candidate) (better, worse candidate) {
+	switch {
+	case held.Resp == nil || c.rank < held.rank:
+		return c, held
+	case c.rank == rankRejected && held.rank == rankRejected:
+		return c, held
+	case c.rank == held.rank && c.Index < held.Index:
+		return c, held
+	}
+	return held, c
+}
+
+// statusRank ranks status codes by their class: 2xx, 3xx, 4xx, 5xx and everything else.
+func statusRank(code int) int {
+	switch {
+	case code >= 200 && code < 300:
+		return rankBest
+	case code >= 300 && code < 600:
+		return code/100 - 2
+	default:
+		return 4
+	}
+}
+
+// isHedgeable reports whether requests with the given method can be sent more than once.
+func (ht *hedgedTransport) isHedgeable(method string) bool {
+	if method == "" {
+		method = http.MethodGet
+	}
+	for _, m := range ht.hedgeableMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRetryAfter reports whether the response has a valid Retry-After header,
+// either in delta-seconds or HTTP-date form.
+func hasRetryAfter(resp *http.Response) bool {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return secs >= 0
+	}
+	_, err := http.ParseTime(v)
+	return err == nil
+}
+
+// hasUnknownLength reports whether the request has a body of unknown length.
+func hasUnknownLength(req *http.Request) bool {
+	return req.ContentLength < 0 || req.ContentLength == 0 && req.Body != nil && req.Body != http.NoBody
+}
+
+// hasStopHeader reports whether the response has the header set by WithStopOnHeader.
+func (ht *hedgedTransport) hasStopHeader(resp *http.Response) bool {
+	if ht.stopHeader == "" {
+		return false
+	}
+	values := resp.Header.Values(ht.stopHeader)
+	if ht.stopValue == "" {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if v == ht.stopValue {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBudget reports whether there is enough time before the context deadline to start a new request.
+func (ht *hedgedTransport) hasBudget(ctx context.Context) bool {
+	if ht.minRemainingBudget <= 0 {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || deadline.Sub(ht.clock.Now()) >= ht.minRemainingBudget
+}
+
+// needsClone reports whether request copies are modified and must be deeply cloned.
+func (ht *hedgedTransport) needsClone() bool {
+	return ht.decorator != nil || len(ht.hosts) > 0 || len(ht.weightedHosts) > 0 || len(ht.targetURLs) > 0 ||
+		ht.backupHost != "" || ht.hedgeHeader != "" || ht.groupHeader != ""
 }
 
-func waitResult(ctx context.Context, resultCh <-chan indexedResp, errorCh <-chan error, timeout time.Duration) (indexedResp, error) {
+// pickWeightedHost returns a random host, the probability of each host is proportional to its weight.
+func (ht *hedgedTransport) pickWeightedHost() string {
+	n := ht.rand.Intn(ht.totalWeight)
+	for _, wh := range ht.weightedHosts {
+		if n < wh.weight {
+			return wh.host
+		}
+		n -= wh.weight
+	}
+	return ht.weightedHosts[len(ht.weightedHosts)-1].host
+}
+
+// prepareRequest finalizes the copy of the request for the given attempt.
+func (ht *hedgedTransport) prepareRequest(req *http.Request, attempt int) (*http.Request, error) {
+	// first attempt uses the original body, others must get a fresh copy
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, &getBodyError{err: err}
+		}
+		req.Body = body
+	}
+
+	switch {
+	case len(ht.weightedHosts) > 0 && attempt > 0:
+		host := ht.pickWeightedHost()
+		req.URL.Host = host
+		req.Host = host
+	case len(ht.targetURLs) > 0:
+		u := *ht.targetURLs[attempt%len(ht.targetURLs)]
+		req.URL = &u
+		req.Host = u.Host
+	case ht.backupHost != "" && attempt == 1:
+		req.URL.Host = ht.backupHost
+		req.Host = ht.backupHost
+	}
+
+	if ht.decorator != nil {
+		req = ht.decorate(req, attempt)
+	}
+	return req, nil
+}
+
+// delay returns a timeout before the given attempt.
+// Timeout is clamped so it doesn't exceed the context deadline.
+// Prev keeps the previous delay of the round trip for decorrelated jitter, it can be nil.
+func (ht *hedgedTransport) delay(ctx context.Context, attempt int, prev *time.Duration) time.Duration {
+	timeout := ht.timeout
+	override, overridden := requestTimeout(ctx)
+	switch {
+	case overridden:
+		timeout = override
+	case attempt == 1 && ht.firstHedgeDelay > 0:
+		timeout = ht.firstHedgeDelay
+	case ht.delayFunc != nil:
+		timeout = ht.delayFunc(attempt)
+	case ht.adaptivePercentile > 0:
+		d, ok := ht.stats.firstAttemptLatency.percentile(ht.adaptivePercentile)
+		if !ok {
+			d = ht.adaptiveSeed
+		}
+		ht.stats.setAdaptiveDelay(d)
+		timeout = d
+	case ht.decorrelatedBase > 0:
+		timeout = ht.decorrelatedDelay(prev)
+	}
+	if ht.jitter > 0 {
+		timeout += time.Duration(float64(timeout) * ht.jitter * (2*ht.rand.Float64() - 1))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := deadline.Sub(ht.clock.Now()); timeout > left {
+			timeout = left
+		}
+	}
+	if timeout <= 0 {
+		timeout = time.Nanosecond // smallest possible timeout if not set
+	}
+	return timeout
+}
+
+// decorrelatedDelay returns min(maxDelay, rand(base, prev*3)), prev is base for the first hedged request.
+func (ht *hedgedTransport) decorrelatedDelay(prev *time.Duration) time.Duration {
+	last := ht.decorrelatedBase
+	if prev != nil && *prev > 0 {
+		last = *prev
+	}
+	base := float64(ht.decorrelatedBase)
+	d := time.Duration(base + ht.rand.Float64()*(3*float64(last)-base))
+	if d > ht.decorrelatedCap {
+		d = ht.decorrelatedCap
+	}
+	if prev != nil {
+		*prev = d
+	}
+	return d
+}
+
+// errRequestCanceled is returned when the deprecated http.Request.Cancel channel is closed.
+var errRequestCanceled = errors.New("hedgedhttp: request canceled")
+
+// waitResult waits for a request result. Reports false if the timeout between requests has expired,
+// or if waiting was interrupted by the context, the request Cancel channel, Shutdown or
+// the latency budget, in that case the error is returned. If wrote is not nil, the timeout
+// starts only when wrote is closed.
+func waitResult(ctx context.Context, done, cancel <-chan struct{}, latency <-chan time.Time, wrote <-chan struct{}, resultCh, errorCh <-chan indexedResp, clock Clock, timeout time.Duration) (indexedResp, bool, error) {
 	// try to read result first before blocking on all other channels
 	select {
 	case res := <-resultCh:
-		return res, nil
+		return res, true, nil
 	default:
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
+	}
+
+	// timer isn't needed if there is nothing to start
+	var timer Timer
+	if timeout != infiniteTimeout && wrote == nil {
+		timer = clock.NewTimer(timeout)
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		var timerC <-chan time.Time
+		if timer != nil {
+			timerC = timer.C()
+		}
 
 		select {
 		case res := <-resultCh:
-			return res, nil
+			return res, true, nil
 
-		case reqErr := <-errorCh:
-			return indexedResp{}, reqErr
+		case res := <-errorCh:
+			return res, true, nil
 
 		case <-ctx.Done():
-			return indexedResp{}, ctx.Err()
+			return indexedResp{}, false, ctx.Err()
+
+		case <-cancel:
+			return indexedResp{}, false, errRequestCanceled
+
+		case <-done:
+			return indexedResp{}, false, ErrShutdown
+
+		case <-latency:
+			return indexedResp{}, false, ErrLatencyBudgetExceeded
+
+		case <-wrote:
+			wrote = nil
+			timer = clock.NewTimer(timeout)
+
+		case <-timerC:
+			return indexedResp{}, false, nil // it's not a request timeout, it's timeout BETWEEN consecutive requests
+		}
+	}
+}
+
+// lockedRand is a random source safe for concurrent use.
+type lockedRand struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newLockedRand(source rand.Source) *lockedRand {
+	return &lockedRand{rand: rand.New(source)}
+}
+
+// secureSeed returns a seed from crypto/rand, falls back to the current time if it fails.
+func secureSeed() int64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Float64()
+}
 
-		case <-timer.C:
-			return indexedResp{}, nil // it's not a request timeout, it's timeout BETWEEN consecutive requests
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Intn(n)
+}
+
+// bufferBody reads the request body into memory, so it can be replayed for every attempt.
+// Values of declared trailers are set by the body reader the latest at EOF, so they are
+// complete before any attempt is sent.
+// Returns false if the body is larger than maxSize, in that case the body is still
+// fully available in the returned request, but it cannot be replayed.
+func bufferBody(req *http.Request, maxSize int64) (*http.Request, bool, error) {
+	body := req.Body
+	buf, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		body.Close()
+		return nil, false, err
+	}
+
+	r := new(http.Request)
+	*r = *req
+
+	if int64(len(buf)) > maxSize {
+		r.Body = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(buf), body),
+			Closer: body,
 		}
+		return r, false, nil
+	}
+
+	body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	// declared trailers are sent only with chunked encoding, i.e. when the length is unknown
+	if r.ContentLength <= 0 && len(r.Trailer) == 0 {
+		r.ContentLength = int64(len(buf))
+	}
+	return r, true, nil
+}
+
+// discardResponse drains and closes the response body in background, then calls cancel.
+// Reading small bodies to the end allows to reuse the connection. At most WithMaxConcurrentDrains
+// bodies are drained at once, others wait in a queue. Shutdown and WithDrainTimeout cancel
+// the requests of the bodies, so a slow body cannot delay Shutdown or block the queue.
+func (ht *hedgedTransport) discardResponse(resp *http.Response, cancel func()) {
+	ht.wg.Add(1)
+	task := drainTask{resp: resp, cancel: cancel}
+	if cancel != nil {
+		task.deadline = time.AfterFunc(ht.drainTimeout, cancel)
+	}
+	ht.drainer.mu.Lock()
+	ht.drainer.queue = append(ht.drainer.queue, task)
+	start := ht.drainer.workers < ht.maxDrains
+	if start {
+		ht.drainer.workers++
+	}
+	ht.drainer.mu.Unlock()
+
+	if start {
+		runInPool(ht.drainQueued)
+	}
+}
+
+// drainer is a queue of discarded responses, see discardResponse.
+type drainer struct {
+	mu      sync.Mutex
+	queue   []drainTask
+	workers int
+}
+
+type drainTask struct {
+	resp     *http.Response
+	cancel   func()
+	deadline *time.Timer // cancels the request, see WithDrainTimeout
+}
+
+// drainQueued drains queued responses until the queue is empty.
+func (ht *hedgedTransport) drainQueued() {
+	for {
+		ht.drainer.mu.Lock()
+		if len(ht.drainer.queue) == 0 {
+			ht.drainer.workers--
+			ht.drainer.mu.Unlock()
+			return
+		}
+		task := ht.drainer.queue[0]
+		ht.drainer.queue[0] = drainTask{}
+		ht.drainer.queue = ht.drainer.queue[1:]
+		ht.drainer.mu.Unlock()
+
+		if task.cancel != nil {
+			id := ht.cancels.add(task.cancel)
+			ht.drainResponse(task.resp)
+			ht.cancels.remove(id)
+			task.deadline.Stop()
+			task.cancel()
+		} else {
+			ht.drainResponse(task.resp)
+		}
+		ht.wg.Done()
+	}
+}
+
+// drainResponse drains and closes the response body, so the connection can be reused.
+func (ht *hedgedTransport) drainResponse(resp *http.Response) {
+	limit := ht.drainLimit
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		limit = 0 // HEAD response has no body, reading it may block
 	}
+	drainBody(resp.Body, limit)
+}
+
+func drainBody(body io.ReadCloser, limit int64) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, limit))
+	body.Close()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 type indexedResp struct {
 	Index int
 	Resp  *http.Response
+	Err   error
 }
 
-func reqWithCtx(r *http.Request, ctx context.Context) (*http.Request, func()) {
-	ctx, cancel := context.WithCancel(ctx)
-	req := r.WithContext(ctx)
-	return req, cancel
+// reqWithCtx returns a shallow copy of the request with the given context.
+// If deep is set, the request is deeply cloned, so it can be safely modified.
+func reqWithCtx(r *http.Request, ctx context.Context, deep bool) *http.Request {
+	if deep {
+		return r.Clone(ctx)
+	}
+	return r.WithContext(ctx)
 }
 
 var taskQueue = make(chan func())
@@ -170,49 +1518,3 @@ func runInPool(task func()) {
 		}()
 	}
 }
-
-// MultiError is an error type to track multiple errors. This is used to
-// accumulate errors in cases and return them as a single "error".
-// Insiper by https://github.com/hashicorp/go-multierror
-type MultiError struct {
-	Errors        []error
-	ErrorFormatFn ErrorFormatFunc
-}
-
-func (e *MultiError) Error() string {
-	fn := e.ErrorFormatFn
-	if fn == nil {
-		fn = listFormatFunc
-	}
-	return fn(e.Errors)
-}
-
-func (e *MultiError) String() string {
-	return fmt.Sprintf("*%#v", e.Errors)
-}
-
-// ErrorOrNil returns an error if there are some.
-func (e *MultiError) ErrorOrNil() error {
-	switch {
-	case e == nil || len(e.Errors) == 0:
-		return nil
-	default:
-		return e
-	}
-}
-
-// ErrorFormatFunc is called by MultiError to return the list of errors as a string.
-type ErrorFormatFunc func([]error) string
-
-func listFormatFunc(es []error) string {
-	if len(es) == 1 {
-		return fmt.Sprintf("1 error occurred:\n\t* %s\n\n", es[0])
-	}
-
-	points := make([]string, len(es))
-	for i, err := range es {
-		points[i] = fmt.Sprintf("* %s", err)
-	}
-
-	return fmt.Sprintf("%d errors occurred:\n\t%s\n\n", len(es), strings.Join(points, "\n\t"))
-}
@@ -1,14 +1,32 @@
 package hedgedhttp
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -35,6 +53,5247 @@ func TestUpto(t *testing.T) {
 	}
 }
 
+func TestUptoWithOptions(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const upto = 7
+	client, err := NewClientWithOptions(nil, WithTimeout(10*time.Millisecond), WithUpto(upto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = client.Do(req)
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != upto {
+		t.Fatalf("want %v, got %v", upto, gotRequests)
+	}
+}
+
+func TestOptionsMutuallyExclusive(t *testing.T) {
+	delayFn := func(attempt int) time.Duration { return time.Millisecond }
+
+	_, err := NewClientWithOptions(nil, WithTimeout(time.Millisecond), WithDelayFunc(delayFn), WithUpto(3))
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("Unexpected err %+v", err)
+	}
+}
+
+func TestOptionsRepeated(t *testing.T) {
+	cfg, err := newConfig(WithTimeout(time.Millisecond), WithTimeout(5*time.Millisecond), WithUpto(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.timeout != 5*time.Millisecond {
+		t.Fatalf("want the last timeout %v, got %v", 5*time.Millisecond, cfg.timeout)
+	}
+	_, err = newConfig(WithTimeout(time.Millisecond), WithDelayFunc(nil), WithTimeout(time.Millisecond), WithUpto(3))
+	if err == nil || err.Error() != "hedgedhttp: options WithTimeout, WithDelayFunc are mutually exclusive" {
+		t.Fatalf("want mutually exclusive error, got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	const upto = 3
+	client, stats, err := NewClientAndStats(10*time.Millisecond, upto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := stats.RequestedRoundTrips(); got != 1 {
+		t.Fatalf("want %v, got %v", 1, got)
+	}
+	if got := stats.ActualRoundTrips(); got != upto {
+		t.Fatalf("want %v, got %v", upto, got)
+	}
+	if got := stats.CanceledSubRequests(); got != upto-1 {
+		t.Fatalf("want %v, got %v", upto-1, got)
+	}
+}
+
+func TestStatsStatusCounts(t *testing.T) {
+	codes := []int{http.StatusOK, http.StatusServiceUnavailable, 0, http.StatusOK, http.StatusNotFound, 0}
+	var calls int64
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		code := codes[atomic.AddInt64(&calls, 1)-1]
+		if code == 0 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+	})
+
+	stats := &Stats{}
+	client, err := NewClientWithOptions(&http.Client{Transport: rt}, WithUpto(1), WithStats(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range codes {
+		resp, err := client.Get("http://localhost")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	want := map[int]uint64{http.StatusOK: 2, http.StatusServiceUnavailable: 1, http.StatusNotFound: 1}
+	if got := stats.StatusCounts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if got := stats.ErrorCount(); got != 2 {
+		t.Fatalf("want %v, got %v", 2, got)
+	}
+}
+
+func TestStatsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	const upto = 3
+	client, stats, err := NewClientAndStats(time.Millisecond, upto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+
+	waitFor(t, func() bool { return stats.InFlight() == upto })
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return stats.InFlight() == 0 })
+}
+
+// waitFor waits until cond is true, fails the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not satisfied in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDirectRoundTrip(t *testing.T) {
+	errRefused := errors.New("connection refused")
+	var fail bool
+	var gotReq *http.Request
+	clock := newFakeClock()
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		gotReq = req
+		clock.Advance(10 * time.Millisecond)
+		if fail {
+			return nil, errRefused
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	stats := &Stats{}
+	mw, err := NewMiddleware(WithUpto(1), WithStats(stats), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := mw(rt)
+
+	req, err := http.NewRequest("GET", "http://localhost", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ht.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !ht.(*hedgedTransport).direct {
+		t.Fatal("want the request to be sent directly")
+	}
+	if gotReq.URL != req.URL || gotReq.Header.Get("X-Attempt") != "" {
+		t.Fatal("want the request to be sent as is")
+	}
+	if idx, ok := AttemptIndex(resp); idx != 0 || !ok {
+		t.Fatalf("want attempt index %v, got %v, %v", 0, idx, ok)
+	}
+	if got := RoundTripsForResponse(resp); got != 1 {
+		t.Fatalf("want %v round trips, got %v", 1, got)
+	}
+	if got := ScheduleForResponse(resp); len(got) != 0 {
+		t.Fatalf("want empty schedule, got %v", got)
+	}
+	if _, _, max := stats.FirstAttemptLatencyStats(); max != 10*time.Millisecond {
+		t.Fatalf("want latency %v, got %v", 10*time.Millisecond, max)
+	}
+
+	fail = true
+	_, err = ht.RoundTrip(req)
+	var hedgedErr *HedgedError
+	if !errors.As(err, &hedgedErr) || !errors.Is(hedgedErr.Errors[0], errRefused) {
+		t.Fatalf("want HedgedError with %v, got %v", errRefused, err)
+	}
+
+	if got := stats.ActualRoundTrips(); got != 2 {
+		t.Fatalf("want %v, got %v", 2, got)
+	}
+	if got := stats.ErrorCount(); got != 1 {
+		t.Fatalf("want %v, got %v", 1, got)
+	}
+	if got := stats.InFlight(); got != 0 {
+		t.Fatalf("want %v, got %v", 0, got)
+	}
+}
+
+func TestClock(t *testing.T) {
+	started := make(chan int, 3)
+	release := make(chan struct{})
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := AttemptIndex(&http.Response{Request: req})
+		started <- idx
+		select {
+		case <-release:
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	})
+
+	clock := newFakeClock()
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(10*time.Millisecond),
+		WithUpto(3),
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := client.Get("http://localhost")
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+
+	if idx := <-started; idx != 0 {
+		t.Fatalf("want attempt %v, got %v", 0, idx)
+	}
+	for attempt := 1; attempt < 3; attempt++ {
+		clock.waitTimers(t, 1)
+		clock.Advance(9 * time.Millisecond)
+		if n := clock.pendingTimers(); n != 1 {
+			t.Fatalf("attempt %d: want the timer still pending, got %v timers", attempt, n)
+		}
+		clock.Advance(time.Millisecond)
+		if idx := <-started; idx != attempt {
+			t.Fatalf("want attempt %v, got %v", attempt, idx)
+		}
+	}
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if n := clock.pendingTimers(); n != 0 {
+		t.Fatalf("want no timers after all requests are started, got %v", n)
+	}
+}
+
+func TestClockDeadline(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+
+	t.Run("delay", func(t *testing.T) {
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		})
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(time.Hour), WithUpto(2), WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Minute))
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+
+		// delay is clamped to the time left by the clock
+		clock.waitTimers(t, 1)
+		if got := clock.nextTimer(); got != time.Minute {
+			t.Fatalf("want delay %v, got %v", time.Minute, got)
+		}
+		cancel()
+		<-done
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			clock.Advance(10 * time.Second)
+			return nil, errors.New("failed")
+		})
+		stats := &Stats{}
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(time.Second), WithUpto(2), WithClock(clock),
+			WithMinRemainingBudget(55*time.Second), WithStats(stats))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Minute))
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Do(req); err == nil {
+			t.Fatal("want error")
+		}
+		// 50s are left by the clock after the first attempt, less than the budget
+		if got := stats.ActualRoundTrips(); got != 1 {
+			t.Fatalf("want %v requests, got %v", 1, got)
+		}
+	})
+}
+
+func TestClockEvents(t *testing.T) {
+	clock := newFakeClock()
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clock.Advance(50 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	events := make(chan Event, 8)
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(time.Second), WithUpto(2), WithEventChannel(events), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if e := <-events; e.Type != EventStarted {
+		t.Fatalf("want %v, got %v", EventStarted, e.Type)
+	}
+	e := <-events
+	if e.Type != EventCompleted {
+		t.Fatalf("want %v, got %v", EventCompleted, e.Type)
+	}
+	if e.Latency != 50*time.Millisecond {
+		t.Fatalf("want latency %v, got %v", 50*time.Millisecond, e.Latency)
+	}
+}
+
+// fakeClock is a Clock which is advanced manually.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward and fires expired timers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func (c *fakeClock) pendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// nextTimer returns the time left until the earliest pending timer fires.
+func (c *fakeClock) nextTimer() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next time.Duration
+	for i, t := range c.timers {
+		if d := t.when.Sub(c.now); i == 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// waitTimers waits until n timers are pending.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+	waitFor(t, func() bool { return c.pendingTimers() == n })
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// checkSchedule checks with a fake clock that hedged requests are started after
+// the given delays from the previous ones, no request gets a response.
+func checkSchedule(t *testing.T, delays []time.Duration, opts ...Option) {
+	t.Helper()
+	started := make(chan int, len(delays)+1)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+		started <- idx
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	clock := newFakeClock()
+	client, err := NewClientWithOptions(&http.Client{Transport: rt}, append(opts, WithClock(clock))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	if idx := <-started; idx != 0 {
+		t.Fatalf("want attempt %v, got %v", 0, idx)
+	}
+	for i, delay := range delays {
+		attempt := i + 1
+		if delay > 0 {
+			clock.waitTimers(t, 1)
+			if got := clock.nextTimer(); got != delay {
+				t.Fatalf("attempt %d: want delay %v, got %v", attempt, delay, got)
+			}
+			clock.Advance(delay)
+		}
+		if idx := <-started; idx != attempt {
+			t.Fatalf("want attempt %v, got %v", attempt, idx)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestFastSuccessCleanup(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	clock := newFakeClock()
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(time.Hour),
+		WithUpto(3),
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func() {
+		resp, err := client.Get("http://localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// warm up the pool of goroutines which run requests
+	for i := 0; i < 10; i++ {
+		do()
+	}
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		do()
+		if n := clock.pendingTimers(); n != 0 {
+			t.Fatalf("want timer stopped after the response, got %v pending", n)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Fatalf("want no leaked goroutines, got %v before and %v after", before, after)
+	}
+}
+
+func TestStatsSnapshotAndReset(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	stats := &Stats{}
+	client, err := NewClientWithOptions(&http.Client{Transport: rt}, WithUpto(1), WithStats(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, requests = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				resp, err := client.Get("http://localhost")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+		// snapshots taken concurrently must not race with requests
+		_ = stats.Snapshot()
+	}
+	wg.Wait()
+
+	want := StatsSnapshot{
+		RequestedRoundTrips: workers * requests,
+		ActualRoundTrips:    workers * requests,
+		StatusCounts:        map[int]uint64{http.StatusOK: workers * requests},
+	}
+	if got := stats.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	stats.Reset()
+	want = StatsSnapshot{StatusCounts: map[int]uint64{}}
+	if got := stats.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestRegretMetric(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusInternalServerError}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+		select {
+		case <-time.After(40 * time.Millisecond):
+			return &http.Response{StatusCode: statuses[idx], Body: http.NoBody}, nil
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	})
+
+	stats := &Stats{}
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(5*time.Millisecond),
+		WithUpto(len(statuses)),
+		WithRegretMetric(stats),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the first response is returned as is, before better ones have arrived
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("want %v, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if regret := stats.Regret(); regret != 0 {
+		t.Fatalf("want no regret yet, got %v", regret)
+	}
+	// only 200 is better, 500 has the same status class
+	waitFor(t, func() bool { return stats.Regret() == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if regret := stats.Regret(); regret != 1 {
+		t.Fatalf("want %v, got %v", 1, regret)
+	}
+}
+
+func TestDirectRoundTripOptIn(t *testing.T) {
+	testCases := []struct {
+		opt    Option
+		direct bool
+	}{
+		{WithTimeout(time.Second), true},
+		{WithStats(&Stats{}), true},
+		{WithAdaptiveDelay(90), true},
+		{WithName("users"), true},
+		{WithErrorClassifier(func(error) bool { return true }), true},
+		{WithResponseValidator(func(*http.Response) bool { return true }), false},
+		{WithOnAttemptComplete(func(int, time.Duration, *http.Response, error) {}), false},
+		{WithTracer(&recordingTracer{events: new([]string)}), false},
+		{WithResponseSelector(func([]*http.Response) int { return 0 }), false},
+		{WithHedgeHeader("X-Attempt"), false},
+		{WithPerAttemptTimeout(time.Second), false},
+	}
+	for i, tc := range testCases {
+		cfg, err := newConfig(WithUpto(1), tc.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := newHedgedTransport(cfg, nil).direct; got != tc.direct {
+			t.Fatalf("option %d: want direct %v, got %v", i, tc.direct, got)
+		}
+	}
+}
+
+// TestDirectConfigFields fails when a config field is added without deciding
+// whether it's checked by canSendDirectly.
+func TestDirectConfigFields(t *testing.T) {
+	checked := []string{
+		"validator", "triggerOnInvalid", "selector", "quorum",
+		"decorator", "contextTagger", "dialerForAttempt", "proxyForAttempt", "clientForAttempt",
+		"hedgeHeader", "groupHeader", "hosts", "weightedHosts", "targetURLs", "backupHost",
+		"breaker", "rateLimiter", "perAttemptTimeout", "latencyBudget",
+		"onAttemptComplete", "onAttemptCancel", "tracer", "logger",
+	}
+	// don't affect the first request, are decided before the round trip or are supported by directTrip
+	unchecked := []string{
+		"timeout", "upto", "delayFunc", "delayOpts", "expBase", "expFactor", "firstHedgeDelay",
+		"decorrelatedBase", "decorrelatedCap", "jitter", "jitterSeed", "seedSet", "randSource",
+		"adaptivePercentile", "adaptiveSeed", "adaptiveWindow", "immediateFanout", "hedgeAfterWrite",
+		"progressDetector", "hedgeOnHeaders", "minRemainingBudget", "totalBudget", "maxConcurrency",
+		"respectRetryAfter", "stopHeader", "stopValue", "backupDelay", "backupTimeout", "onHedge",
+		"maxBufferedBody", "maxHedgeableLen", "hedgeableLenSet", "hedgeableMethods", "dryRun",
+		"policy", "successStatuses", "selectorMode", "redirects", "drainLimit", "maxDrains",
+		"drainTimeout", "loserGrace", "separateConns", "totalWeight", "equal", "quorumBodyLimit",
+		"stats", "regret", "clock", "name", "named", "classifier", "errorAggregation",
+	}
+
+	classified := map[string]bool{}
+	for _, name := range append(checked, unchecked...) {
+		if classified[name] {
+			t.Fatalf("field %v is classified twice", name)
+		}
+		classified[name] = true
+	}
+	typ := reflect.TypeOf(config{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if !classified[name] {
+			t.Errorf("config field %v is not classified for canSendDirectly", name)
+		}
+		delete(classified, name)
+	}
+	for name := range classified {
+		t.Errorf("classified field %v doesn't exist", name)
+	}
+}
+
+func TestShutdownCancelsDirectRoundTrip(t *testing.T) {
+	started := make(chan struct{})
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	stats := &Stats{}
+	mw, err := NewMiddleware(WithUpto(1), WithStats(stats))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := mw(http.DefaultTransport)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := (&http.Client{Transport: rt}).Get(url)
+		errCh <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rt.(interface{ Shutdown(context.Context) error }).Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; !errors.Is(err, ErrShutdown) {
+		t.Fatalf("want %v, got %v", ErrShutdown, err)
+	}
+	if got := stats.ErrorCount(); got != 0 {
+		t.Fatalf("want request canceled by shutdown not counted, got %v errors", got)
+	}
+}
+
+func TestExponentialDelay(t *testing.T) {
+	cfg, err := newConfig(WithExponentialDelay(10*time.Millisecond, 2), WithUpto(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := newHedgedTransport(cfg, nil)
+
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond}
+	for i, w := range want {
+		if got := ht.delay(context.Background(), i+1, nil); got != w {
+			t.Fatalf("attempt %d: want %v, got %v", i+1, w, got)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if got := ht.delay(ctx, 4, nil); got > 30*time.Millisecond {
+		t.Fatalf("want delay clamped to deadline, got %v", got)
+	}
+
+	if got := ht.delay(context.Background(), 1000, nil); got != infiniteTimeout {
+		t.Fatalf("want %v, got %v", infiniteTimeout, got)
+	}
+}
+
+func TestExponentialDelayInvalid(t *testing.T) {
+	_, err := NewClientWithOptions(nil, WithExponentialDelay(time.Millisecond, 0.5), WithUpto(3))
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	_, err = NewClientWithOptions(nil, WithExponentialDelay(time.Millisecond, 2), WithTimeout(time.Millisecond), WithUpto(3))
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestExponentialDelaySchedule(t *testing.T) {
+	checkSchedule(t, []time.Duration{20 * time.Millisecond, 80 * time.Millisecond},
+		WithExponentialDelay(20*time.Millisecond, 4), WithUpto(3))
+}
+
+func TestFirstHedgeDelay(t *testing.T) {
+	testCases := []struct {
+		opt  Option
+		want []time.Duration
+	}{
+		{WithTimeout(5 * time.Millisecond), []time.Duration{50 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond}},
+		{WithExponentialDelay(10*time.Millisecond, 2), []time.Duration{50 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}},
+		{WithAdaptiveDelay(90), []time.Duration{50 * time.Millisecond, 0, 0}},
+	}
+
+	for _, tc := range testCases {
+		cfg, err := newConfig(tc.opt, WithUpto(4), WithFirstHedgeDelay(50*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ht := newHedgedTransport(cfg, nil)
+
+		for i, w := range tc.want {
+			if w == 0 {
+				w = time.Nanosecond // adaptive delay has no seed
+			}
+			if got := ht.delay(context.Background(), i+1, nil); got != w {
+				t.Fatalf("attempt %d: want %v, got %v", i+1, w, got)
+			}
+		}
+	}
+
+	cfg, err := newConfig(WithTimeout(5*time.Millisecond), WithUpto(2), WithFirstHedgeDelay(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithRequestTimeout(context.Background(), time.Millisecond)
+	if got := newHedgedTransport(cfg, nil).delay(ctx, 1, nil); got != time.Millisecond {
+		t.Fatalf("want request timeout to win, got %v", got)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const timeout = 10 * time.Millisecond
+	newTransport := func(fraction float64) *hedgedTransport {
+		cfg, err := newConfig(WithTimeout(timeout), WithUpto(3), WithJitter(fraction), WithJitterSeed(42))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newHedgedTransport(cfg, nil)
+	}
+
+	ht1, ht2 := newTransport(0.5), newTransport(0.5)
+	for i := 0; i < 1000; i++ {
+		d1, d2 := ht1.delay(context.Background(), 1, nil), ht2.delay(context.Background(), 1, nil)
+		if d1 != d2 {
+			t.Fatalf("want same delays for same seed, got %v and %v", d1, d2)
+		}
+		if d1 < timeout/2 || d1 > timeout*3/2 {
+			t.Fatalf("delay %v is out of jitter range", d1)
+		}
+	}
+
+	ht := newTransport(1)
+	for i := 0; i < 1000; i++ {
+		if d := ht.delay(context.Background(), 1, nil); d <= 0 {
+			t.Fatalf("want positive delay, got %v", d)
+		}
+	}
+
+	if _, err := newConfig(WithUpto(1), WithJitter(1.5)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	cfg, err := newConfig(
+		WithTimeout(timeout),
+		WithUpto(3),
+		WithJitter(0.5),
+		WithWeightedHosts(map[string]int{"a": 1, "b": 1, "c": 2}),
+		WithRandSource(rand.NewSource(7)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := newHedgedTransport(cfg, nil)
+
+	// same seed gives the same sequence of decisions
+	want := rand.New(rand.NewSource(7))
+	hosts := []string{"a", "b", "c", "c"}
+	for i := 0; i < 20; i++ {
+		wantDelay := timeout + time.Duration(float64(timeout)*0.5*(2*want.Float64()-1))
+		if got := ht.delay(context.Background(), 1, nil); got != wantDelay {
+			t.Fatalf("step %d: want delay %v, got %v", i, wantDelay, got)
+		}
+		wantHost := hosts[want.Intn(4)]
+		if got := ht.pickWeightedHost(); got != wantHost {
+			t.Fatalf("step %d: want host %v, got %v", i, wantHost, got)
+		}
+	}
+}
+
+func TestDecorrelatedJitter(t *testing.T) {
+	const base, maxDelay = 10 * time.Millisecond, 200 * time.Millisecond
+	cfg, err := newConfig(WithDecorrelatedJitter(base, maxDelay), WithUpto(10), WithRandSource(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := newHedgedTransport(cfg, nil)
+
+	var capped int
+	for i := 0; i < 1000; i++ {
+		var prev time.Duration
+		for attempt := 1; attempt < 10; attempt++ {
+			d := ht.delay(context.Background(), attempt, &prev)
+			if d < base || d > maxDelay {
+				t.Fatalf("want delay in [%v, %v], got %v", base, maxDelay, d)
+			}
+			if attempt == 1 && d > 3*base {
+				t.Fatalf("want first delay in [%v, %v], got %v", base, 3*base, d)
+			}
+			if d == maxDelay {
+				capped++
+			}
+		}
+	}
+	if capped == 0 {
+		t.Fatal("want some delays to reach the max delay")
+	}
+
+	for _, opt := range []Option{WithDecorrelatedJitter(0, time.Second), WithDecorrelatedJitter(time.Second, time.Millisecond)} {
+		if _, err := newConfig(opt, WithUpto(2)); err == nil {
+			t.Fatal("want error, got nil")
+		}
+	}
+}
+
+func BenchmarkDecorrelatedJitter(b *testing.B) {
+	cfg, err := newConfig(WithDecorrelatedJitter(10*time.Millisecond, time.Second), WithUpto(10))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ht := newHedgedTransport(cfg, nil)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var prev time.Duration
+	for i := 0; i < b.N; i++ {
+		ht.delay(ctx, i%10+1, &prev)
+	}
+}
+
+func TestDelayFunc(t *testing.T) {
+	schedule := []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond, -time.Second}
+	var calls []int
+
+	start := time.Now()
+	arrivals := make(chan time.Duration, len(schedule))
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		arrivals <- time.Since(start)
+		time.Sleep(300 * time.Millisecond)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delayFn := func(attempt int) time.Duration {
+		calls = append(calls, attempt)
+		return schedule[attempt]
+	}
+	client, err := NewClientWithOptions(nil, WithDelayFunc(delayFn), WithUpto(len(schedule)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = client.Do(req)
+
+	if want := []int{1, 2, 3}; fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, calls)
+	}
+
+	got := make([]time.Duration, len(schedule))
+	for i := range got {
+		got[i] = <-arrivals
+	}
+	if got[1] > 80*time.Millisecond {
+		t.Fatalf("want 2nd attempt after ~10ms, got %v", got[1])
+	}
+	if got[2] < 100*time.Millisecond {
+		t.Fatalf("want 3rd attempt after at least 110ms, got %v", got[2])
+	}
+	if gap := got[3] - got[2]; gap > 50*time.Millisecond {
+		t.Fatalf("want 4th attempt immediately after 3rd, got %v", gap)
+	}
+}
+
+func TestDelayFuncSchedule(t *testing.T) {
+	schedule := []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond, -time.Second}
+	delayFn := func(attempt int) time.Duration {
+		return schedule[attempt]
+	}
+	// negative delay is replaced by the smallest possible one
+	checkSchedule(t, []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Nanosecond},
+		WithDelayFunc(delayFn), WithUpto(len(schedule)))
+}
+
+func TestBufferedBody(t *testing.T) {
+	const upto = 3
+	const payload = "hedged request body"
+	bodies := make(chan string, upto)
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	body := &closeCounter{Reader: io.MultiReader(strings.NewReader(payload))}
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewClient(5*time.Millisecond, upto, nil).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < upto; i++ {
+		if got := <-bodies; got != payload {
+			t.Fatalf("want %q, got %q", payload, got)
+		}
+	}
+	if closed := atomic.LoadInt64(&body.closed); closed != 1 {
+		t.Fatalf("want body closed once, got %v", closed)
+	}
+}
+
+func TestBufferedBodyTooLarge(t *testing.T) {
+	const payload = "hedged request body"
+	var gotRequests int64
+	bodies := make(chan string, 1)
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	body := &closeCounter{Reader: io.MultiReader(strings.NewReader(payload))}
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil, WithTimeout(5*time.Millisecond), WithUpto(3), WithMaxBufferedBody(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := <-bodies; got != payload {
+		t.Fatalf("want %q, got %q", payload, got)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+	if closed := atomic.LoadInt64(&body.closed); closed != 1 {
+		t.Fatalf("want body closed once, got %v", closed)
+	}
+}
+
+func TestBufferedMultipartBody(t *testing.T) {
+	type upload struct {
+		boundary, raw, fields, checksum string
+	}
+	testCases := []struct {
+		name         string
+		maxBuffered  int64
+		wantRequests int
+	}{
+		{"buffered", 1 << 20, 3},
+		{"too large", 16, 1},
+	}
+
+	for _, tc := range testCases {
+		uploads := make(chan upload, tc.wantRequests)
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			var u upload
+			_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				t.Error(err)
+			}
+			u.boundary = params["boundary"]
+			raw, _ := io.ReadAll(r.Body)
+			u.raw = string(raw)
+			u.checksum = r.Trailer.Get("X-Checksum") // available after the body is read
+
+			mr := multipart.NewReader(bytes.NewReader(raw), u.boundary)
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					if err != io.EOF {
+						u.fields += "malformed: " + err.Error()
+					}
+					break
+				}
+				value, _ := io.ReadAll(part)
+				u.fields += part.FormName() + "=" + string(value) + ";"
+			}
+			uploads <- u
+			time.Sleep(50 * time.Millisecond)
+		})
+
+		// streamed body of unknown length with the checksum sent as a trailer
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		req, err := http.NewRequest("PUT", url, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Trailer = http.Header{"X-Checksum": nil}
+		go func() {
+			mw.WriteField("name", "hedged")
+			fw, _ := mw.CreateFormFile("file", "data.txt")
+			fw.Write([]byte("file contents"))
+			mw.Close()
+			req.Trailer.Set("X-Checksum", "42")
+			pw.Close()
+		}()
+
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithMaxBufferedBody(tc.maxBuffered),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		first := <-uploads
+		want := upload{
+			boundary: mw.Boundary(),
+			raw:      first.raw,
+			fields:   "name=hedged;file=file contents;",
+			checksum: "42",
+		}
+		if first != want {
+			t.Fatalf("%s: want %+v, got %+v", tc.name, want, first)
+		}
+		for i := 1; i < tc.wantRequests; i++ {
+			if got := <-uploads; got != want {
+				t.Fatalf("%s: attempt %d: want %+v, got %+v", tc.name, i, want, got)
+			}
+		}
+		select {
+		case got := <-uploads:
+			t.Fatalf("%s: want %d requests, got another one %+v", tc.name, tc.wantRequests, got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestGetBody(t *testing.T) {
+	const upto = 3
+	payload := []byte(`{"key":"value","list":[1,2,3]}`)
+	bodies := make(chan []byte, upto)
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := NewClient(5*time.Millisecond, upto, nil).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < upto; i++ {
+		if got := <-bodies; !bytes.Equal(got, payload) {
+			t.Fatalf("want %s, got %s", payload, got)
+		}
+	}
+}
+
+func TestGetBodyError(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	req, err := http.NewRequest("PUT", url, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return nil, errors.New("cannot get body")
+	}
+
+	resp, err := NewClient(5*time.Millisecond, 3, nil).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+}
+
+func TestResponseValidator(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&gotRequests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(5),
+		WithResponseValidator(func(resp *http.Response) bool {
+			return resp.StatusCode != http.StatusServiceUnavailable
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected resp status code: %+v", resp.StatusCode)
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	testCases := []struct {
+		name         string
+		result       ValidationResult
+		wantStatus   int
+		wantRequests int64
+	}{
+		{"accept", Accept, http.StatusUnauthorized, 1},
+		{"reject and retry", RejectRetry, http.StatusOK, 2},
+		{"reject and stop", RejectStop, http.StatusUnauthorized, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotRequests int64
+			url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt64(&gotRequests, 1) == 1 {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			client, err := NewClientWithOptions(nil,
+				WithTimeout(50*time.Millisecond),
+				WithUpto(3),
+				WithResponseValidation(func(resp *http.Response) ValidationResult {
+					if resp.StatusCode == http.StatusUnauthorized {
+						return tc.result
+					}
+					return Accept
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("want status %v, got %v", tc.wantStatus, resp.StatusCode)
+			}
+			if tc.result == RejectStop {
+				if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+					t.Fatalf("want response returned immediately, took %v", elapsed)
+				}
+			}
+			if got := atomic.LoadInt64(&gotRequests); got != tc.wantRequests {
+				t.Fatalf("want %v requests, got %v", tc.wantRequests, got)
+			}
+		})
+	}
+}
+
+func TestPanickingValidator(t *testing.T) {
+	lines := make(chan string, 16)
+	logger := loggerFunc(func(format string, args ...interface{}) {
+		lines <- fmt.Sprintf(format, args...)
+	})
+
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+	})
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(5*time.Millisecond),
+		WithUpto(3),
+		WithResponseValidator(func(resp *http.Response) bool {
+			panic("validator bug")
+		}),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the response is accepted as if there was no validator
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("want %v, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if got := RoundTripsForResponse(resp); got != 1 {
+		t.Fatalf("want %v round trip, got %v", 1, got)
+	}
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "response validator panicked: validator bug") {
+				return
+			}
+		default:
+			t.Fatal("panic is not logged")
+		}
+	}
+}
+
+func TestResponseValidatorAllRejected(t *testing.T) {
+	const upto = 3
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		idx := atomic.AddInt64(&gotRequests, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprint(w, idx)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(upto),
+		WithResponseValidator(func(resp *http.Response) bool {
+			return resp.StatusCode != http.StatusTooManyRequests
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected resp status code: %+v", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != fmt.Sprint(upto) {
+		t.Fatalf("want last response %v, got %s", upto, body)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != upto {
+		t.Fatalf("want %v, got %v", upto, gotRequests)
+	}
+}
+
+func TestValidationTriggeredHedging(t *testing.T) {
+	for _, firstValid := range []bool{true, false} {
+		var gotRequests int64
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&gotRequests, 1) == 1 {
+				time.Sleep(50 * time.Millisecond)
+				if !firstValid {
+					w.Header().Set("X-Invalid", "1")
+				}
+			}
+		})
+
+		var rejectedAt time.Time
+		client, err := NewClientWithOptions(nil,
+			WithUpto(3),
+			WithResponseValidator(func(resp *http.Response) bool {
+				if resp.Header.Get("X-Invalid") != "" {
+					rejectedAt = time.Now()
+					return false
+				}
+				return true
+			}),
+			WithValidationTriggeredHedging(true),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		want := int64(1)
+		if !firstValid {
+			want = 2
+			if passed := time.Since(rejectedAt); passed > 40*time.Millisecond {
+				t.Fatalf("want next request started immediately, took %v", passed)
+			}
+		}
+		if got := atomic.LoadInt64(&gotRequests); got != want {
+			t.Fatalf("first valid %v: want %v requests, got %v", firstValid, want, got)
+		}
+		if resp.Header.Get("X-Invalid") != "" {
+			t.Fatal("want valid response")
+		}
+	}
+
+	if _, err := NewClientWithOptions(nil, WithUpto(2), WithValidationTriggeredHedging(true)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestBestStatusPolicy(t *testing.T) {
+	testCases := []struct {
+		statuses []int
+		policy   SelectionPolicy
+		want     int
+	}{
+		{[]int{500, 503, 200}, PolicyBestStatus, 200},
+		{[]int{500, 404, 503}, PolicyBestStatus, 404},
+		{[]int{503, 302, 404}, PolicyBestStatus, 302},
+		{[]int{500, 404, 200}, PolicyFirstDone, 500},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+		statuses := tc.statuses
+
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			idx := atomic.AddInt64(&gotRequests, 1)
+			w.WriteHeader(statuses[idx-1])
+		})
+
+		req, err := http.NewRequest("GET", url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewClientWithOptions(&http.Client{CheckRedirect: noRedirect},
+			WithTimeout(5*time.Millisecond),
+			WithUpto(len(statuses)),
+			WithSelectionPolicy(tc.policy),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.want {
+			t.Fatalf("statuses %v: want %v, got %v", statuses, tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestFirstSuccessPolicy(t *testing.T) {
+	testCases := []struct {
+		statuses []int
+		success  []int
+		want     int
+	}{
+		{[]int{500, 503, 200}, nil, 200},
+		{[]int{500, 204, 200}, nil, 204},
+		{[]int{500, 404, 503}, nil, 503},
+		{[]int{200, 404, 500}, []int{404}, 404},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+		bodies := make([]*closeCounter, len(tc.statuses))
+		for i := range bodies {
+			bodies[i] = &closeCounter{Reader: strings.NewReader("body")}
+		}
+
+		rt := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			idx := atomic.AddInt64(&gotRequests, 1) - 1
+			return &http.Response{StatusCode: tc.statuses[idx], Body: bodies[idx]}, nil
+		})
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(5*time.Millisecond),
+			WithUpto(len(tc.statuses)),
+			WithSelectionPolicy(PolicyFirstSuccess),
+			WithSuccessStatuses(tc.success),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Fatalf("statuses %v: want %v, got %v", tc.statuses, tc.want, resp.StatusCode)
+		}
+
+		time.Sleep(20 * time.Millisecond) // discarded bodies are closed in background
+		for i, body := range bodies[:atomic.LoadInt64(&gotRequests)] {
+			want := int64(1)
+			if tc.statuses[i] == tc.want {
+				want = 0
+			}
+			if closed := atomic.LoadInt64(&body.closed); closed != want {
+				t.Fatalf("statuses %v: response %d closed %v times, want %v", tc.statuses, i, closed, want)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestAttemptIndex(t *testing.T) {
+	const upto = 3
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&gotRequests, 1) < upto {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(upto),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if idx, ok := AttemptIndex(resp); !ok || idx != upto-1 {
+		t.Fatalf("want attempt %v, got %v (%v)", upto-1, idx, ok)
+	}
+	if _, ok := AttemptIndex(&http.Response{}); ok {
+		t.Fatal("want no attempt index for foreign response")
+	}
+}
+
+func TestRoundTripsForResponse(t *testing.T) {
+	testCases := []struct {
+		sleep time.Duration
+		want  int
+	}{
+		{0, 1},
+		{100 * time.Millisecond, 3},
+	}
+
+	for _, tc := range testCases {
+		sleep := tc.sleep
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(sleep)
+		})
+
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(10*time.Millisecond),
+			WithUpto(3),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if got := RoundTripsForResponse(resp); got != tc.want {
+			t.Fatalf("sleep %v: want %v, got %v", sleep, tc.want, got)
+		}
+	}
+	if got := RoundTripsForResponse(&http.Response{}); got != 0 {
+		t.Fatalf("want %v, got %v", 0, got)
+	}
+}
+
+func TestScheduleForResponse(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") != "2" {
+			<-r.Context().Done()
+			return
+		}
+	})
+
+	delayFunc := func(attempt int) time.Duration {
+		return time.Duration(attempt) * 10 * time.Millisecond
+	}
+	get := func(opts ...Option) []time.Duration {
+		t.Helper()
+		opts = append(opts, WithUpto(4), WithDelayFunc(delayFunc), WithHedgeHeader("X-Attempt"))
+		client, err := NewClientWithOptions(nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return ScheduleForResponse(resp)
+	}
+
+	// attempt 2 wins, so attempt 3 is never sent
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+	if got := get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	const jitter = 0.5
+	schedule := get(WithJitter(jitter))
+	if len(schedule) != len(want) {
+		t.Fatalf("want delays of %v hedged requests, got %v", len(want), schedule)
+	}
+	var jittered bool
+	for i, d := range schedule {
+		if d < want[i]/2 || d > want[i]*3/2 {
+			t.Fatalf("attempt %d: want delay within %v ± %v%%, got %v", i+1, want[i], jitter*100, d)
+		}
+		jittered = jittered || d != want[i]
+	}
+	if !jittered {
+		t.Fatalf("want jittered delays, got %v", schedule)
+	}
+
+	if got := ScheduleForResponse(&http.Response{}); got != nil {
+		t.Fatalf("want nil schedule for a response of another client, got %v", got)
+	}
+}
+
+func TestImmediateFanout(t *testing.T) {
+	const sleep = 50 * time.Millisecond
+	var inFlight, maxInFlight, gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		if atomic.AddInt64(&gotRequests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(sleep)
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(0),
+		WithUpto(4),
+		WithImmediateFanout(true),
+		WithMaxConcurrency(2),
+		WithSelectionPolicy(PolicyFirstSuccess),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if passed := time.Since(start); passed > sleep+sleep/2 {
+		t.Fatalf("want about %v, got %v", sleep, passed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+	if max := atomic.LoadInt64(&maxInFlight); max > 2 {
+		t.Fatalf("want at most %v requests in flight, got %v", 2, max)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 3 {
+		t.Fatalf("want %v, got %v", 3, gotRequests)
+	}
+}
+
+func TestLatencyBudget(t *testing.T) {
+	errFirst := errors.New("first attempt failed")
+	var canceled int64
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx == 0 {
+			return nil, errFirst
+		}
+		<-req.Context().Done()
+		atomic.AddInt64(&canceled, 1)
+		return nil, req.Context().Err()
+	})
+
+	const budget = 50 * time.Millisecond
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(10*time.Millisecond),
+		WithUpto(3),
+		WithLatencyBudget(budget),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = client.Get("http://example.com")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrLatencyBudgetExceeded) {
+		t.Fatalf("want %v, got %v", ErrLatencyBudgetExceeded, err)
+	}
+	var budgetErr *LatencyBudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("want *LatencyBudgetError, got %T", err)
+	}
+	if budgetErr.Budget != budget || len(budgetErr.Errors) != 1 || budgetErr.Errors[0] != errFirst {
+		t.Fatalf("want budget %v and error of the first attempt, got %v and %v", budget, budgetErr.Budget, budgetErr.Errors)
+	}
+	if elapsed < budget || elapsed > budget+30*time.Millisecond {
+		t.Fatalf("want round trip failed after %v, took %v", budget, elapsed)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&canceled) == 2 })
+}
+
+func TestPerAttemptTimeout(t *testing.T) {
+	const upto = 3
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&gotRequests, 1) < upto {
+			<-r.Context().Done() // hangs past the per attempt timeout
+		}
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Second),
+		WithUpto(upto),
+		WithMaxConcurrency(1),
+		WithPerAttemptTimeout(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if passed := time.Since(start); passed > 500*time.Millisecond {
+		t.Fatalf("want hanging requests to time out, took %v", passed)
+	}
+	if idx, _ := AttemptIndex(resp); idx != upto-1 {
+		t.Fatalf("want attempt %v, got %v", upto-1, idx)
+	}
+}
+
+func TestPerAttemptTimeoutAllFailed(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithPerAttemptTimeout(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get(url)
+	var hedgedErr *HedgedError
+	if !errors.As(err, &hedgedErr) {
+		t.Fatalf("want HedgedError, got %v", err)
+	}
+	if len(hedgedErr.Errors) != 2 {
+		t.Fatalf("want %v errors, got %v", 2, hedgedErr.Errors)
+	}
+	for _, err := range hedgedErr.Errors {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+		}
+	}
+}
+
+func TestRespectRetryAfter(t *testing.T) {
+	testCases := []struct {
+		retryAfter string
+		want       int64
+	}{
+		{"120", 1},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 1},
+		{"soon", 3},
+		{"-1", 3},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+		retryAfter := tc.retryAfter
+
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&gotRequests, 1)
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithSelectionPolicy(PolicyFirstSuccess),
+			WithRespectRetryAfter(true),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("want %v, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != tc.want {
+			t.Fatalf("retry after %q: want %v requests, got %v", retryAfter, tc.want, gotRequests)
+		}
+	}
+}
+
+func TestStopOnHeader(t *testing.T) {
+	testCases := []struct {
+		name, value string
+		want        int64
+	}{
+		{"x-overloaded", "1", 1},
+		{"X-Overloaded", "", 1},
+		{"X-Overloaded", "0", 3},
+		{"X-Other", "", 3},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&gotRequests, 1) == 1 {
+				w.Header().Set("X-Overloaded", "1")
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithSelectionPolicy(PolicyFirstSuccess),
+			WithStopOnHeader(tc.name, tc.value),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("want %v, got %v", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != tc.want {
+			t.Fatalf("header %q=%q: want %v requests, got %v", tc.name, tc.value, tc.want, gotRequests)
+		}
+	}
+}
+
+func TestHedgeableMethods(t *testing.T) {
+	testCases := []struct {
+		method string
+		opts   []Option
+		want   int64
+	}{
+		{"GET", nil, 3},
+		{"POST", nil, 1},
+		{"POST", []Option{WithHedgeableMethods([]string{"POST"})}, 3},
+		{"GET", []Option{WithHedgeableMethods(nil)}, 1},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&gotRequests, 1)
+			time.Sleep(50 * time.Millisecond)
+		})
+
+		opts := append([]Option{WithTimeout(5 * time.Millisecond), WithUpto(3)}, tc.opts...)
+		client, err := NewClientWithOptions(nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(tc.method, url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != tc.want {
+			t.Fatalf("%s: want %v requests, got %v", tc.method, tc.want, gotRequests)
+		}
+	}
+}
+
+func TestEventChannel(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		switch idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx {
+		case 0:
+			return nil, errors.New("failed")
+		case 1:
+			time.Sleep(50 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		default:
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+	})
+
+	events := make(chan Event, 16)
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(10*time.Millisecond),
+		WithUpto(3),
+		WithEventChannel(events),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := map[string]bool{
+		"0 started": true, "0 errored": true,
+		"1 started": true, "1 completed": true, "1 won": true,
+		"2 started": true, "2 canceled": true,
+	}
+	for len(want) > 0 {
+		select {
+		case e := <-events:
+			key := fmt.Sprintf("%d %s", e.Attempt, e.Type)
+			if !want[key] {
+				t.Fatalf("unexpected event %q", key)
+			}
+			delete(want, key)
+			if e.Type == EventWon && e.Latency < 50*time.Millisecond {
+				t.Fatalf("want latency of the winner, got %v", e.Latency)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("want events %v", want)
+		}
+	}
+}
+
+func TestEventChannelDoesNotBlock(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Second),
+		WithUpto(2),
+		WithEventChannel(make(chan Event)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestOnAttemptComplete(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") == "2" {
+			return // the last request wins
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	type completion struct {
+		latency time.Duration
+		status  int
+		err     error
+	}
+	var mu sync.Mutex
+	completed := map[int]completion{}
+	allDone := make(chan struct{})
+
+	const upto = 3
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(upto),
+		WithHedgeHeader("X-Attempt"),
+		WithOnAttemptComplete(func(attempt int, latency time.Duration, resp *http.Response, err error) {
+			c := completion{latency: latency, err: err}
+			if resp != nil {
+				c.status = resp.StatusCode
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			completed[attempt] = c
+			if len(completed) == upto {
+				close(allDone)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-allDone:
+	case <-time.After(time.Second):
+		t.Fatal("not all requests are completed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for attempt := 0; attempt < upto-1; attempt++ {
+		c := completed[attempt]
+		if !errors.Is(c.err, context.Canceled) {
+			t.Fatalf("attempt %d: want %v, got %v", attempt, context.Canceled, c.err)
+		}
+		if c.latency < time.Duration(upto-1-attempt)*10*time.Millisecond {
+			t.Fatalf("attempt %d: latency %v is too small", attempt, c.latency)
+		}
+	}
+	if c := completed[upto-1]; c.err != nil || c.status != http.StatusOK {
+		t.Fatalf("want %v, got %+v", http.StatusOK, c)
+	}
+}
+
+func TestOnAttemptCompletePanic(t *testing.T) {
+	body := &closeCounter{Reader: strings.NewReader("body")}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+	})
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithUpto(1),
+		WithOnAttemptComplete(func(attempt int, latency time.Duration, resp *http.Response, err error) {
+			panic("hook bug")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get("http://localhost")
+	if err == nil || !strings.Contains(err.Error(), "hook bug") {
+		t.Fatalf("want panic error, got %v", err)
+	}
+	if closed := atomic.LoadInt64(&body.closed); closed != 1 {
+		t.Fatalf("want response body closed once, got %v", closed)
+	}
+}
+
+func TestLoserGracePeriod(t *testing.T) {
+	testCases := []struct {
+		name  string
+		grace time.Duration
+		conns int
+	}{
+		{"canceled", 0, 4}, // connection of the loser is closed in every round trip
+		{"grace period", time.Second, 2},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			conns := map[string]bool{}
+			var canceled int32
+			url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				conns[r.RemoteAddr] = true
+				mu.Unlock()
+				if r.Header.Get("X-Attempt") != "0" {
+					return
+				}
+				select {
+				case <-time.After(30 * time.Millisecond):
+				case <-r.Context().Done():
+					atomic.AddInt32(&canceled, 1)
+				}
+			})
+
+			// the connection is put back to the pool before RoundTrip returns a response without body
+			var finished int32
+			transport := &http.Transport{}
+			defer transport.CloseIdleConnections()
+			rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				defer atomic.AddInt32(&finished, 1)
+				return transport.RoundTrip(req)
+			})
+			client, err := NewClientWithOptions(&http.Client{Transport: rt},
+				WithTimeout(10*time.Millisecond),
+				WithUpto(2),
+				WithHedgeHeader("X-Attempt"),
+				WithLoserGracePeriod(tc.grace),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			const rounds = 3
+			for i := 1; i <= rounds; i++ {
+				resp, err := client.Get(url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if idx, _ := AttemptIndex(resp); idx != 1 {
+					t.Fatalf("want response of attempt %v, got %v", 1, idx)
+				}
+				waitFor(t, func() bool { return atomic.LoadInt32(&finished) == int32(2*i) })
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(conns) != tc.conns {
+				t.Fatalf("want %v connections, got %v", tc.conns, len(conns))
+			}
+			if tc.grace > 0 && atomic.LoadInt32(&canceled) != 0 {
+				t.Fatalf("want no canceled requests, got %v", canceled)
+			}
+		})
+	}
+}
+
+func TestOnAttemptCanceled(t *testing.T) {
+	errFailed := errors.New("failed")
+	testCases := []struct {
+		name         string
+		winner       int
+		failed       int // attempt which fails at once, -1 for none
+		wantCanceled []int
+	}{
+		{"first wins", 0, -1, []int{1, 2}},
+		{"failed and hanging", 2, 1, []int{0, 1}},
+	}
+
+	for _, tc := range testCases {
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			switch idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx {
+			case tc.winner:
+				time.Sleep(20 * time.Millisecond)
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			case tc.failed:
+				return nil, errFailed
+			}
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		})
+
+		var mu sync.Mutex
+		canceled := map[int]int{}
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithOnAttemptCanceled(func(attempt int) {
+				mu.Lock()
+				canceled[attempt]++
+				mu.Unlock()
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if idx, _ := AttemptIndex(resp); idx != tc.winner {
+			t.Fatalf("%s: want winner %v, got %v", tc.name, tc.winner, idx)
+		}
+
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(canceled) == len(tc.wantCanceled)
+		})
+		time.Sleep(20 * time.Millisecond) // no more callbacks
+		mu.Lock()
+		for _, idx := range tc.wantCanceled {
+			if canceled[idx] != 1 {
+				t.Fatalf("%s: want attempt %v canceled once, got %v", tc.name, idx, canceled)
+			}
+		}
+		if _, ok := canceled[tc.winner]; ok || len(canceled) != len(tc.wantCanceled) {
+			t.Fatalf("%s: want %v canceled, got %v", tc.name, tc.wantCanceled, canceled)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestAttemptConnTrace(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	var reused []bool
+	client, err := NewClientWithOptions(&http.Client{Transport: &http.Transport{}},
+		WithUpto(1),
+		WithOnAttemptComplete(func(attempt int, latency time.Duration, resp *http.Response, err error) {
+			trace, ok := AttemptConnTrace(resp)
+			if !ok {
+				t.Error("want connection trace")
+			}
+			if trace.GotConn <= 0 || trace.GotConn > latency {
+				t.Errorf("want GotConn within latency %v, got %v", latency, trace.GotConn)
+			}
+			reused = append(reused, trace.Reused)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var userGotConn int
+	userTrace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { userGotConn++ },
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), userTrace)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := AttemptConnTrace(resp); !ok {
+			t.Fatal("want connection trace for the returned response")
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if want := []bool{false, true}; !reflect.DeepEqual(reused, want) {
+		t.Fatalf("want %v, got %v", want, reused)
+	}
+	if userGotConn != 2 {
+		t.Fatalf("want user trace to be called %v times, got %v", 2, userGotConn)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	var plan HedgePlan
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(20*time.Millisecond),
+		WithUpto(5),
+		WithDryRun(func(p HedgePlan) {
+			plan = p
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+	if len(plan.Delays) != 4 {
+		t.Fatalf("want %v delays, got %v", 4, plan.Delays)
+	}
+	for _, d := range plan.Delays {
+		if d != 20*time.Millisecond {
+			t.Fatalf("want %v, got %v", 20*time.Millisecond, d)
+		}
+	}
+	if plan.Latency < 50*time.Millisecond {
+		t.Fatalf("want latency of the first request, got %v", plan.Latency)
+	}
+	if want := predictAttempts(plan.Delays, plan.Latency); plan.Attempts != want || want < 3 {
+		t.Fatalf("want %v attempts, got %v", want, plan.Attempts)
+	}
+}
+
+func TestPredictAttempts(t *testing.T) {
+	ms := time.Millisecond
+	testCases := []struct {
+		delays  []time.Duration
+		latency time.Duration
+		want    int
+	}{
+		{nil, 100 * ms, 1},
+		{[]time.Duration{20 * ms, 20 * ms, 20 * ms, 20 * ms}, 50 * ms, 3},
+		{[]time.Duration{20 * ms, 20 * ms, 20 * ms, 20 * ms}, 10 * ms, 1},
+		{[]time.Duration{20 * ms, 20 * ms, 20 * ms, 20 * ms}, 100 * ms, 5},
+		{[]time.Duration{20 * ms, 20 * ms}, 40 * ms, 2},
+	}
+
+	for _, tc := range testCases {
+		if got := predictAttempts(tc.delays, tc.latency); got != tc.want {
+			t.Fatalf("delays %v, latency %v: want %v, got %v", tc.delays, tc.latency, tc.want, got)
+		}
+	}
+}
+
+func TestRecommendUpto(t *testing.T) {
+	ms := time.Millisecond
+	// bimodal returns fast latencies of 50ms per 100 samples, others are 500ms
+	bimodal := func(fast int) []time.Duration {
+		latencies := make([]time.Duration, 100)
+		for i := range latencies {
+			latencies[i] = 500 * ms
+			if i < fast {
+				latencies[i] = 50 * ms
+			}
+		}
+		return latencies
+	}
+	uniform := make([]time.Duration, 100) // 1ms..100ms
+	for i := range uniform {
+		uniform[i] = time.Duration(i+1) * ms
+	}
+
+	testCases := []struct {
+		latencies  []time.Duration
+		target     time.Duration
+		confidence float64
+		want       int
+	}{
+		{nil, 100 * ms, 0.99, 0},
+		{bimodal(100), 100 * ms, 0.99, 1},
+		{bimodal(0), 100 * ms, 0.99, 0},
+		{bimodal(90), 100 * ms, 0.99, 2},
+		{bimodal(90), 100 * ms, 0.999, 3},
+		{bimodal(50), 100 * ms, 0.99, 7},
+		{bimodal(50), 100 * ms, 0.5, 1},
+		{bimodal(50), 100 * ms, 0, 1},
+		{bimodal(50), 100 * ms, 1, 0},
+		{bimodal(50), 500 * ms, 1, 1},
+		{uniform, 10 * ms, 0.99, 44},
+		{uniform, 50 * ms, 0.99, 7},
+	}
+	for _, tc := range testCases {
+		got := RecommendUpto(tc.latencies, tc.target, tc.confidence)
+		if got != tc.want {
+			t.Fatalf("target %v, confidence %v: want %v, got %v", tc.target, tc.confidence, tc.want, got)
+		}
+	}
+
+	// sampling the distribution confirms the estimate
+	r := rand.New(rand.NewSource(1))
+	const trials = 10000
+	upto := RecommendUpto(uniform, 10*ms, 0.99)
+	success := 0
+	for i := 0; i < trials; i++ {
+		for j := 0; j < upto; j++ {
+			if uniform[r.Intn(len(uniform))] <= 10*ms {
+				success++
+				break
+			}
+		}
+	}
+	if rate := float64(success) / trials; rate < 0.985 {
+		t.Fatalf("want success rate >= 0.99, got %v", rate)
+	}
+}
+
+func TestTotalBudget(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(150 * time.Millisecond)
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(50),
+		WithTotalBudget(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// requests are started at 0, 10, ..., 100ms
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests < 5 || gotRequests > 11 {
+		t.Fatalf("want about %v requests, got %v", 10, gotRequests)
+	}
+}
+
+func ExampleNewMiddleware() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	chain := func(base http.RoundTripper, mws ...Middleware) http.RoundTripper {
+		for i := len(mws) - 1; i >= 0; i-- {
+			base = mws[i](base)
+		}
+		return base
+	}
+	auth := func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("Authorization", "Bearer token")
+			return next.RoundTrip(req)
+		})
+	}
+
+	hedged, err := NewMiddleware(WithTimeout(10*time.Millisecond), WithUpto(3))
+	if err != nil {
+		panic(err)
+	}
+	client := &http.Client{Transport: chain(http.DefaultTransport, auth, hedged)}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(string(body))
+
+	// Output: Bearer token
+}
+
+func ExampleBuilder() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	client, err := NewBuilder().
+		Timeout(10 * time.Millisecond).
+		Upto(3).
+		Client(&http.Client{}).
+		Build()
+	if err != nil {
+		panic(err)
+	}
+
+	// same as
+	_, err = NewClientWithOptions(&http.Client{}, WithTimeout(10*time.Millisecond), WithUpto(3))
+	if err != nil {
+		panic(err)
+	}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(string(body))
+
+	// Output: ok
+}
+
+func ExampleWithRequestDecorator() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cache-Control") != "no-cache" {
+			time.Sleep(100 * time.Millisecond) // slow cache
+			fmt.Fprint(w, "cache")
+			return
+		}
+		fmt.Fprint(w, "origin")
+	}))
+	defer srv.Close()
+
+	// the primary request may be served by a cache, the backup request goes to the origin
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(10*time.Millisecond),
+		WithUpto(2),
+		WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			if attempt == 1 {
+				req.Header.Set("Cache-Control", "no-cache")
+			}
+			return req
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(string(body))
+
+	// Output: origin
+}
+
+func TestBuilder(t *testing.T) {
+	delayFunc := func(attempt int) time.Duration { return time.Duration(attempt) * time.Millisecond }
+
+	client, err := NewBuilder().Upto(3).DelayFunc(delayFunc).With(WithMaxConcurrency(2)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := client.Transport.(*hedgedTransport)
+
+	want, err := newConfig(WithUpto(3), WithDelayFunc(delayFunc), WithMaxConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ht.upto != want.upto || ht.maxConcurrency != want.maxConcurrency {
+		t.Fatalf("want %+v, got %+v", want, ht.config)
+	}
+	if got := ht.delay(context.Background(), 2, nil); got != 2*time.Millisecond {
+		t.Fatalf("want %v, got %v", 2*time.Millisecond, got)
+	}
+
+	if _, err := NewBuilder().Timeout(time.Millisecond).DelayFunc(delayFunc).Upto(2).Build(); err == nil {
+		t.Fatal("want error, got nil")
+	}
+
+	// the last value of the same option wins
+	client, err = NewBuilder().Timeout(time.Millisecond).Timeout(5 * time.Millisecond).Upto(2).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Transport.(*hedgedTransport).timeout; got != 5*time.Millisecond {
+		t.Fatalf("want %v, got %v", 5*time.Millisecond, got)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &http.Client{
+		Transport:     &http.Transport{},
+		Jar:           jar,
+		CheckRedirect: noRedirect,
+		Timeout:       time.Second,
+	}
+
+	client, err := Wrap(base, WithTimeout(5*time.Millisecond), WithUpto(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == base {
+		t.Fatal("want a copy of the client")
+	}
+	if client.Jar != base.Jar || client.Timeout != base.Timeout || client.CheckRedirect == nil {
+		t.Fatalf("want client settings to be kept, got %+v", client)
+	}
+	if _, ok := base.Transport.(*http.Transport); !ok {
+		t.Fatalf("want original client to be unchanged, got %T", base.Transport)
+	}
+	if ht, ok := client.Transport.(*hedgedTransport); !ok || ht.rt != base.Transport {
+		t.Fatalf("want hedged transport wrapping the original one, got %T", client.Transport)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 3 {
+		t.Fatalf("want %v, got %v", 3, gotRequests)
+	}
+
+	if _, err := Wrap(nil, WithUpto(0)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestStreamingResponse(t *testing.T) {
+	next := make(chan struct{})
+	loserCanceled := make(chan struct{})
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") != "0" {
+			<-r.Context().Done()
+			close(loserCanceled)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "chunk %d\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithHedgeHeader("X-Attempt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	select {
+	case <-loserCanceled:
+	case <-time.After(time.Second):
+		t.Fatal("want loser canceled while the winner is streaming")
+	}
+
+	// every chunk is sent only after the previous one is read, so the body must stream through
+	buf := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("chunk %d\n", i); line != want {
+			t.Fatalf("want %q, got %q", want, line)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestPolicyWaitAll(t *testing.T) {
+	var done int64
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		attempt, _ := strconv.Atoi(r.Header.Get("X-Attempt"))
+		select {
+		case <-time.After(time.Duration(5-attempt) * 10 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		atomic.AddInt64(&done, 1)
+		w.Header().Set("X-Attempt", strconv.Itoa(attempt))
+	})
+
+	const upto = 5
+	var selected int
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Millisecond),
+		WithUpto(upto),
+		WithHedgeHeader("X-Attempt"),
+		WithSelectionPolicy(PolicyWaitAll),
+		WithResponseSelector(func(candidates []*http.Response) int {
+			if got := atomic.LoadInt64(&done); got != upto {
+				t.Errorf("want %v completed requests, got %v", upto, got)
+			}
+			selected = len(candidates)
+			best := 0
+			for i, resp := range candidates {
+				if resp.Header.Get("X-Attempt") == "0" {
+					best = i
+				}
+			}
+			return best
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if selected != upto {
+		t.Fatalf("want %v candidates, got %v", upto, selected)
+	}
+	if got := resp.Header.Get("X-Attempt"); got != "0" {
+		t.Fatalf("want %v, got %v", "0", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("want round trip canceled early, took %v", elapsed)
+	}
+}
+
+func TestSelectionTieBreak(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy SelectionPolicy
+		status int
+	}{
+		{"wait all", PolicyWaitAll, http.StatusOK},
+		{"best status", PolicyBestStatus, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var started sync.WaitGroup
+			started.Add(2)
+			rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+				started.Done()
+				started.Wait()
+				if idx == 0 {
+					time.Sleep(10 * time.Millisecond) // attempt 1 always arrives first
+				}
+				header := http.Header{"X-Attempt": []string{strconv.Itoa(idx)}}
+				return &http.Response{StatusCode: tc.status, Header: header, Body: http.NoBody}, nil
+			})
+
+			client, err := NewClientWithOptions(&http.Client{Transport: rt},
+				WithUpto(2),
+				WithImmediateFanout(true),
+				WithSelectionPolicy(tc.policy),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get("http://example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("X-Attempt"); got != "0" {
+				t.Fatalf("want response of attempt 0, got %v", got)
+			}
+		})
+	}
+}
+
+func TestPolicyWaitAllRejected(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+		status := http.StatusOK
+		if idx == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithUpto(2),
+		WithImmediateFanout(true),
+		WithSelectionPolicy(PolicyWaitAll),
+		WithResponseValidator(func(resp *http.Response) bool { return resp.StatusCode < 500 }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want accepted response, got status %v", resp.StatusCode)
+	}
+}
+
+func TestResponseSelector(t *testing.T) {
+	freshest := func(candidates []*http.Response) int {
+		best := 0
+		for i, resp := range candidates {
+			if resp.Header.Get("Last-Modified") > candidates[best].Header.Get("Last-Modified") {
+				best = i
+			}
+		}
+		return best
+	}
+
+	testCases := []struct {
+		mode           SelectorMode
+		wantCandidates int
+		wantModified   string
+	}{
+		{SelectOnFirstReady, 2, "2"},
+		{SelectOnAllDone, 3, "3"},
+	}
+
+	for _, tc := range testCases {
+		bodies := make([]*closeCounter, 3)
+		for i := range bodies {
+			bodies[i] = &closeCounter{Reader: strings.NewReader("body")}
+		}
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+			status := http.StatusOK
+			if idx == 0 {
+				status = http.StatusInternalServerError
+			}
+			time.Sleep(time.Duration(idx) * 10 * time.Millisecond)
+			header := http.Header{"Last-Modified": []string{strconv.Itoa(idx + 1)}}
+			return &http.Response{StatusCode: status, Header: header, Body: bodies[idx]}, nil
+		})
+
+		var gotCandidates int
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(time.Millisecond),
+			WithUpto(3),
+			WithSelectionPolicy(PolicyFirstSuccess),
+			WithResponseSelector(func(candidates []*http.Response) int {
+				gotCandidates = len(candidates)
+				return freshest(candidates)
+			}),
+			WithSelectorMode(tc.mode),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotCandidates != tc.wantCandidates {
+			t.Fatalf("mode %v: want %v candidates, got %v", tc.mode, tc.wantCandidates, gotCandidates)
+		}
+		if got := resp.Header.Get("Last-Modified"); got != tc.wantModified {
+			t.Fatalf("mode %v: want %v, got %v", tc.mode, tc.wantModified, got)
+		}
+
+		time.Sleep(50 * time.Millisecond) // discarded bodies are closed in background
+		for i, body := range bodies {
+			want := int64(1)
+			if strconv.Itoa(i+1) == tc.wantModified {
+				want = 0
+			}
+			if closed := atomic.LoadInt64(&body.closed); closed != want {
+				t.Fatalf("mode %v: response %d closed %v times, want %v", tc.mode, i, closed, want)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestResponseSelectorFallback(t *testing.T) {
+	for _, idx := range []int{-1, 2} {
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempt, _ := req.Context().Value(attemptIndexKey{}).(int)
+			status := http.StatusOK
+			if attempt == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+		})
+
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithUpto(2),
+			WithImmediateFanout(true),
+			WithSelectorMode(SelectOnAllDone),
+			WithResponseSelector(func(candidates []*http.Response) int { return idx }),
+			WithResponseValidator(func(resp *http.Response) bool { return resp.StatusCode < 500 }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("http://example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("index %v: want accepted response, got status %v", idx, resp.StatusCode)
+		}
+	}
+}
+
+func TestSelectLargestContentLength(t *testing.T) {
+	lengths := []int{20, 40, 30} // truncated mirrors return shorter bodies
+	bodies := make([]*closeCounter, len(lengths))
+	for i, n := range lengths {
+		bodies[i] = &closeCounter{Reader: strings.NewReader(strings.Repeat("x", n))}
+	}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			ContentLength: int64(lengths[idx]),
+			Body:          bodies[idx],
+		}, nil
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(time.Millisecond),
+		WithUpto(len(lengths)),
+		WithResponseSelector(SelectLargestContentLength),
+		WithSelectorMode(SelectOnAllDone),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != 40 {
+		t.Fatalf("want %v, got %v", 40, resp.ContentLength)
+	}
+
+	time.Sleep(50 * time.Millisecond) // discarded bodies are closed in background
+	for i, body := range bodies {
+		want := int64(1)
+		if i == 1 {
+			want = 0
+		}
+		if closed := atomic.LoadInt64(&body.closed); closed != want {
+			t.Fatalf("response %d closed %v times, want %v", i, closed, want)
+		}
+	}
+	resp.Body.Close()
+
+	testCases := []struct {
+		statuses []int
+		lengths  []int64
+		want     int
+	}{
+		{[]int{200, 200}, []int64{-1, 0}, 1},
+		{[]int{200, 200}, []int64{-1, -1}, 0},
+		{[]int{500, 200}, []int64{100, -1}, 1},
+		{[]int{200, 206, 200}, []int64{10, 10, 5}, 0},
+		{[]int{500, 404}, []int64{10, 20}, -1},
+	}
+	for _, tc := range testCases {
+		candidates := make([]*http.Response, len(tc.statuses))
+		for i := range candidates {
+			candidates[i] = &http.Response{StatusCode: tc.statuses[i], ContentLength: tc.lengths[i]}
+		}
+		if got := SelectLargestContentLength(candidates); got != tc.want {
+			t.Fatalf("%v %v: want %v, got %v", tc.statuses, tc.lengths, tc.want, got)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	})
+
+	const interval = 30 * time.Millisecond
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Millisecond),
+		WithUpto(3),
+		WithRateLimiter(&intervalLimiter{interval: interval}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrivals) != 3 {
+		t.Fatalf("want %v requests, got %v", 3, len(arrivals))
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < interval-5*time.Millisecond {
+			t.Fatalf("request %d: want requests serialized by %v, got %v", i, interval, gap)
+		}
+	}
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	events := make(chan Event, 16)
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Millisecond),
+		WithUpto(3),
+		WithRateLimiter(&intervalLimiter{interval: time.Hour}),
+		WithEventChannel(events),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	canceled := 0
+	for canceled < 2 {
+		select {
+		case e := <-events:
+			if e.Type == EventCanceled {
+				canceled++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("want 2 requests waiting for the limiter to be canceled, got %v", canceled)
+		}
+	}
+}
+
+// intervalLimiter allows a request once per interval.
+type intervalLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&gotRequests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	breaker := &fakeBreaker{allowed: 2}
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(5),
+		WithSelectionPolicy(PolicyFirstSuccess),
+		WithCircuitBreaker(breaker),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 3 {
+		t.Fatalf("want %v, got %v", 3, gotRequests)
+	}
+
+	time.Sleep(50 * time.Millisecond) // canceled requests are finished in background
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if breaker.failures != 1 || breaker.successes != 1 {
+		t.Fatalf("want 1 failure and 1 success, got %v and %v", breaker.failures, breaker.successes)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	var methods []string
+	var mu sync.Mutex
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+	})
+
+	rt, err := NewRoundTripper(10*time.Millisecond, 2, &http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prewarmer, ok := rt.(interface {
+		Prewarm(ctx context.Context, url string) error
+	})
+	if !ok {
+		t.Fatal("round tripper doesn't implement Prewarm")
+	}
+	if err := prewarmer.Prewarm(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !reused {
+		t.Fatal("want prewarmed connection to be reused")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"HEAD", "GET"}; !reflect.DeepEqual(methods, want) {
+		t.Fatalf("want %v, got %v", want, methods)
+	}
+
+	if err := prewarmer.Prewarm(context.Background(), "http://[::1"); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestHedgeAfterWriteRequest(t *testing.T) {
+	const dialDelay = 100 * time.Millisecond
+
+	for _, gated := range []bool{false, true} {
+		var start time.Time
+		arrivals := make(chan time.Duration, 2)
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			arrivals <- time.Since(start)
+			time.Sleep(200 * time.Millisecond)
+		})
+
+		// only the first connection is slow to set up
+		var dials int64
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if atomic.AddInt64(&dials, 1) == 1 {
+					time.Sleep(dialDelay)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+		client, err := NewClientWithOptions(&http.Client{Transport: transport},
+			WithTimeout(10*time.Millisecond),
+			WithUpto(2),
+			WithHedgeAfterWriteRequest(gated),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start = time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+
+		// arrivals are in order of arrival, not in order of attempts
+		first, second := <-arrivals, <-arrivals
+		switch {
+		case gated && (first < dialDelay || second < first+10*time.Millisecond):
+			t.Fatalf("want second request delayed until the first is written, got %v and %v", first, second)
+		case !gated && first >= dialDelay:
+			t.Fatalf("want second request sent during the slow dial, got %v and %v", first, second)
+		}
+	}
+}
+
+func TestProgressDetector(t *testing.T) {
+	for _, detect := range []bool{false, true} {
+		var gotRequests int64
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&gotRequests, 1)
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints) // slow but working
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(w, "chunk %d\n", i)
+				w.(http.Flusher).Flush()
+			}
+		})
+
+		stats := &Stats{}
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(10*time.Millisecond),
+			WithUpto(3),
+			WithProgressDetector(detect),
+			WithStats(stats),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		want := uint64(3)
+		if detect {
+			want = 1
+		}
+		if got := stats.ActualRoundTrips(); got != want {
+			t.Fatalf("detect %v: want %v requests, got %v", detect, want, got)
+		}
+	}
+}
+
+func TestHedgeOnHeaderTimeout(t *testing.T) {
+	const payload = "large download\n"
+	t.Run("slow body", func(t *testing.T) {
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK) // fast headers
+			w.(http.Flusher).Flush()
+			for i := 0; i < 5; i++ {
+				time.Sleep(10 * time.Millisecond)
+				fmt.Fprint(w, payload)
+				w.(http.Flusher).Flush()
+			}
+		})
+
+		stats := &Stats{}
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithHedgeOnHeaderTimeout(true),
+			WithStats(stats),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != strings.Repeat(payload, 5) {
+			t.Fatalf("want full body, got %q, %v", body, err)
+		}
+		if got := stats.ActualRoundTrips(); got != 1 {
+			t.Fatalf("want %v request, got %v", 1, got)
+		}
+	})
+
+	t.Run("slow final headers", func(t *testing.T) {
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusEarlyHints) // the first byte arrives in time
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+		})
+
+		stats := &Stats{}
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithHedgeOnHeaderTimeout(true),
+			WithStats(stats),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := stats.ActualRoundTrips(); got != 1 {
+			t.Fatalf("want %v request, got %v", 1, got)
+		}
+	})
+
+	t.Run("rejected response", func(t *testing.T) {
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Attempt") == "0" {
+				w.WriteHeader(http.StatusEarlyHints)
+				time.Sleep(20 * time.Millisecond)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+
+		stats := &Stats{}
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(5*time.Millisecond),
+			WithUpto(3),
+			WithHedgeHeader("X-Attempt"),
+			WithSelectionPolicy(PolicyFirstSuccess),
+			WithHedgeOnHeaderTimeout(true),
+			WithStats(stats),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// the rejected response doesn't count, the second request is started after it
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("want status %v, got %v", http.StatusOK, resp.StatusCode)
+		}
+		if got := stats.ActualRoundTrips(); got != 2 {
+			t.Fatalf("want %v requests, got %v", 2, got)
+		}
+	})
+
+	t.Run("hedged request started", func(t *testing.T) {
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Attempt") == "0" {
+				<-r.Context().Done() // no headers at all
+				return
+			}
+			w.WriteHeader(http.StatusEarlyHints)
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		})
+
+		stats := &Stats{}
+		client, err := NewClientWithOptions(nil,
+			WithTimeout(10*time.Millisecond),
+			WithUpto(4),
+			WithHedgeHeader("X-Attempt"),
+			WithHedgeOnHeaderTimeout(true),
+			WithStats(stats),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if idx, _ := AttemptIndex(resp); idx != 1 {
+			t.Fatalf("want response of attempt %v, got %v", 1, idx)
+		}
+		// the first request has timed out, the second has started receiving a response
+		if got := stats.ActualRoundTrips(); got != 2 {
+			t.Fatalf("want %v requests, got %v", 2, got)
+		}
+	})
+}
+
+func TestWithName(t *testing.T) {
+	for _, name := range []string{"", "users service", "users{x}", "%s"} {
+		if _, err := NewClientWithOptions(nil, WithUpto(2), WithName(name)); err == nil {
+			t.Fatalf("want error for name %q", name)
+		}
+	}
+
+	var mu sync.Mutex
+	var logs []string
+	var names []string
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		names = append(names, ClientName(req.Context()))
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	stats := &Stats{}
+	var buf bytes.Buffer
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithName("users-v2"),
+		WithTimeout(time.Second),
+		WithUpto(2),
+		WithStats(stats),
+		WithLogger(loggerFunc(func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		})),
+		WithJSONLogger(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return buf.Write(p)
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.HasSuffix(buf.Bytes(), []byte("\n"))
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(names) != 1 || names[0] != "users-v2" {
+		t.Fatalf("want client name in request context, got %q", names)
+	}
+	if len(logs) == 0 {
+		t.Fatal("want log messages")
+	}
+	for _, msg := range logs {
+		if !strings.HasPrefix(msg, "[users-v2] hedgedhttp: ") {
+			t.Fatalf("want message prefixed with client name, got %q", msg)
+		}
+	}
+	var line struct {
+		Client string `json:"client"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line.Client != "users-v2" {
+		t.Fatalf("want client %q in %q, got %v", "users-v2", buf.String(), err)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	errFirst := errors.New(`dial "a": refused`)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx == 0 {
+			return nil, errFirst
+		}
+		return &http.Response{StatusCode: http.StatusCreated, Body: http.NoBody}, nil
+	})
+
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(10*time.Millisecond),
+		WithUpto(3),
+		WithHedgeGroupHeader("X-Group"),
+		WithJSONLogger(w),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.HasSuffix(buf.Bytes(), []byte("\n"))
+	})
+	mu.Lock()
+	line := buf.String()
+	mu.Unlock()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("want a single line, got %q", line)
+	}
+
+	var got struct {
+		GroupID       string          `json:"group_id"`
+		Attempts      int             `json:"attempts"`
+		Delays        []time.Duration `json:"delays"`
+		WinnerAttempt int             `json:"winner_attempt"`
+		WinnerStatus  int             `json:"winner_status"`
+		TotalLatency  time.Duration   `json:"total_latency"`
+		Errors        []string        `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", line, err)
+	}
+	if got.GroupID != resp.Request.Header.Get("X-Group") || got.GroupID == "" {
+		t.Fatalf("want group id %q, got %q", resp.Request.Header.Get("X-Group"), got.GroupID)
+	}
+	if want := []time.Duration{0, 10 * time.Millisecond}; got.Attempts != 2 || !reflect.DeepEqual(got.Delays, want) {
+		t.Fatalf("want 2 attempts with delays %v, got %v %v", want, got.Attempts, got.Delays)
+	}
+	if got.WinnerAttempt != 1 || got.WinnerStatus != http.StatusCreated {
+		t.Fatalf("want winner 1 with %v, got %v with %v", http.StatusCreated, got.WinnerAttempt, got.WinnerStatus)
+	}
+	if got.TotalLatency <= 0 {
+		t.Fatalf("want positive latency, got %v", got.TotalLatency)
+	}
+	if len(got.Errors) != 1 || got.Errors[0] != errFirst.Error() {
+		t.Fatalf("want [%q], got %q", errFirst, got.Errors)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestSeparateConnections(t *testing.T) {
+	for _, separate := range []bool{false, true} {
+		var mu sync.Mutex
+		conns := map[string]bool{}
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				t.Errorf("want HTTP/2, got %v", r.Proto)
+			}
+			mu.Lock()
+			conns[r.RemoteAddr] = true
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+		}))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+
+		const upto = 3
+		client, err := NewClientWithOptions(srv.Client(),
+			WithTimeout(5*time.Millisecond),
+			WithUpto(upto),
+			WithSeparateConnections(separate),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		srv.Close()
+
+		want := 1
+		if separate {
+			want = upto
+		}
+		mu.Lock()
+		if got := len(conns); got != want {
+			t.Fatalf("separate %v: want %v connections, got %v", separate, want, got)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestDialerForAttempt(t *testing.T) {
+	var mu sync.Mutex
+	remoteAddrs := map[string]string{} // attempt -> client address seen by the server
+	dialedAddrs := map[string]string{} // dialer -> local address of its connection
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		attempt := r.Header.Get("X-Attempt")
+		mu.Lock()
+		remoteAddrs[attempt] = r.RemoteAddr
+		mu.Unlock()
+		if attempt == "0" {
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+
+	newDialer := func(name string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				mu.Lock()
+				dialedAddrs[name] = conn.LocalAddr().String()
+				mu.Unlock()
+			}
+			return conn, err
+		}
+	}
+	dialers := map[int]string{0: "primary", 1: "secondary"}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithHedgeHeader("X-Attempt"),
+		WithDialerForAttempt(func(attempt int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return newDialer(dialers[attempt])
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for attempt, name := range dialers {
+		got, want := remoteAddrs[strconv.Itoa(attempt)], dialedAddrs[name]
+		if want == "" || got != want {
+			t.Fatalf("attempt %d: want connection dialed by %s from %q, got %q", attempt, name, want, got)
+		}
+	}
+}
+
+func TestProxyForAttempt(t *testing.T) {
+	var mu sync.Mutex
+	var direct []string
+	var proxied []string // attempt and request URI seen by the proxy
+	var proxyConns []string
+
+	target := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		direct = append(direct, r.Header.Get("X-Attempt"))
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	})
+	proxy := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Header.Get("X-Attempt")+" "+r.RequestURI)
+		proxyConns = append(proxyConns, r.RemoteAddr)
+		mu.Unlock()
+		w.Header().Set("X-Via", "proxy")
+	})
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithHedgeHeader("X-Attempt"),
+		WithProxyForAttempt(func(attempt int) func(*http.Request) (*url.URL, error) {
+			if attempt == 1 {
+				return http.ProxyURL(proxyURL)
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const roundTrips = 2
+	for i := 0; i < roundTrips; i++ {
+		resp, err := client.Get(target + "/resource")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Via") != "proxy" {
+			t.Fatalf("want response of the proxy, got %v", resp.Header)
+		}
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(direct) == roundTrips
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < roundTrips; i++ {
+		if want := "1 " + target + "/resource"; proxied[i] != want {
+			t.Fatalf("want proxied %q, got %q", want, proxied[i])
+		}
+		if direct[i] != "0" {
+			t.Fatalf("want attempt 0 sent directly, got %q", direct[i])
+		}
+	}
+	// the transport of the proxy is kept between round trips
+	if proxyConns[0] != proxyConns[1] {
+		t.Fatalf("want a reused proxy connection, got %v", proxyConns)
+	}
+}
+
+func TestClientForAttempt(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Client") == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.Copy(w, r.Body)
+	})
+
+	newClient := func(name string) *http.Client {
+		return &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("X-Client", name)
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+	}
+	slow, fast := newClient("slow"), newClient("fast")
+
+	var gotBase int64
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&gotBase, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: base},
+		WithTimeout(10*time.Millisecond),
+		WithUpto(3),
+		WithClientForAttempt(func(attempt int) *http.Client {
+			switch attempt {
+			case 0:
+				return slow
+			case 1:
+				return fast
+			default:
+				return nil
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("PUT", url, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("want %q, got %q", "hello", body)
+	}
+	if idx, _ := AttemptIndex(resp); idx != 1 {
+		t.Fatalf("want attempt %v, got %v", 1, idx)
+	}
+	if got := atomic.LoadInt64(&gotBase); got != 0 {
+		t.Fatalf("want base transport unused, got %v requests", got)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	const upto = 3
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&gotRequests, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	rt, err := NewRoundTripper(5*time.Millisecond, upto, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != upto {
+		t.Fatalf("want %v, got %v", upto, gotRequests)
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const maxConcurrency = 2
+	var inFlight, maxInFlight, gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		if atomic.AddInt64(&gotRequests, 1) < 5 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		cur := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if cur <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, cur) {
+				break
+			}
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(&http.Client{Transport: base},
+		WithTimeout(time.Millisecond),
+		WithUpto(5),
+		WithMaxConcurrency(maxConcurrency),
+		WithSelectionPolicy(PolicyBestStatus),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected resp status code: %+v", resp.StatusCode)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 5 {
+		t.Fatalf("want %v, got %v", 5, gotRequests)
+	}
+	if maxInFlight := atomic.LoadInt64(&maxInFlight); maxInFlight != maxConcurrency {
+		t.Fatalf("want %v requests in flight, got %v", maxConcurrency, maxInFlight)
+	}
+}
+
+func TestPanicReleasesSlot(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt64(&gotRequests, 1) == 1 {
+			panic("boom")
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(&http.Client{Transport: base},
+		WithTimeout(time.Millisecond),
+		WithUpto(2),
+		WithMaxConcurrency(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 2 {
+		t.Fatalf("want %v, got %v", 2, gotRequests)
+	}
+}
+
+func TestRequestDecorator(t *testing.T) {
+	const upto = 3
+	headers := make(chan string, upto)
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Hedge-Attempt")
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(upto),
+		WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			if attempt == 0 {
+				return nil
+			}
+			req.Header.Set("X-Hedge-Attempt", fmt.Sprint(attempt))
+			return req
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := map[string]bool{}
+	for i := 0; i < upto; i++ {
+		got[<-headers] = true
+	}
+	for _, want := range []string{"", "1", "2"} {
+		if !got[want] {
+			t.Fatalf("want header %q, got %v", want, got)
+		}
+	}
+	if h := req.Header.Get("X-Hedge-Attempt"); h != "" {
+		t.Fatalf("original request must not be modified, got %q", h)
+	}
+}
+
+func TestRequestDecoratorHeadersPerAttempt(t *testing.T) {
+	const upto = 3
+	var mu sync.Mutex
+	headers := map[string][]string{}
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers[r.Header.Get("X-Attempt")] = r.Header.Values("Cache-Control")
+		mu.Unlock()
+		<-r.Context().Done()
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cache-Control", "max-age=60")
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(upto),
+		WithHedgeHeader("X-Attempt"),
+		WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			if attempt == 1 {
+				// appending to a value shared with other copies would leak to them
+				req.Header.Add("Cache-Control", "no-cache")
+			}
+			return req
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Do(req.WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string][]string{
+		"0": {"max-age=60"},
+		"1": {"max-age=60", "no-cache"},
+		"2": {"max-age=60"},
+	}
+	if !reflect.DeepEqual(headers, want) {
+		t.Fatalf("want %v, got %v", want, headers)
+	}
+	if got := req.Header.Values("Cache-Control"); !reflect.DeepEqual(got, []string{"max-age=60"}) {
+		t.Fatalf("original request must not be modified, got %v", got)
+	}
+}
+
+func TestContextTagger(t *testing.T) {
+	type tagKey struct{}
+
+	var mu sync.Mutex
+	tags := map[string]bool{}
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tags[r.Header.Get("X-Tag")] = true
+		mu.Unlock()
+		<-r.Context().Done() // only canceled by the transport
+	})
+
+	// propagates the context value as a header, like a logging or tracing middleware
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Tag", req.Context().Value(tagKey{}).(string))
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(time.Millisecond),
+		WithUpto(3),
+		WithContextTagger(func(ctx context.Context, attempt int) context.Context {
+			return context.WithValue(ctx, tagKey{}, "attempt-"+strconv.Itoa(attempt))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"attempt-0": true, "attempt-1": true, "attempt-2": true}
+	if !reflect.DeepEqual(tags, want) {
+		t.Fatalf("want %v, got %v", want, tags)
+	}
+}
+
+func TestHedgeHeaders(t *testing.T) {
+	var mu sync.Mutex
+	attempts := map[string]bool{}
+	groups := map[string]int{}
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.Header.Get("X-Hedged-Attempt")] = true
+		groups[r.Header.Get("X-Hedge-Group-ID")]++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	const upto = 3
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(2*time.Millisecond),
+		WithUpto(upto),
+		WithHedgeHeader("X-Hedged-Attempt"),
+		WithHedgeGroupHeader("X-Hedge-Group-ID"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	time.Sleep(50 * time.Millisecond) // wait for canceled requests
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"0": true, "1": true, "2": true}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Fatalf("want %v, got %v", want, attempts)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("want 2 group IDs, got %v", groups)
+	}
+	for id, n := range groups {
+		if len(id) != 36 || n != upto {
+			t.Fatalf("want %v requests with a UUID, got %v with %q", upto, n, id)
+		}
+	}
+	if req.Header.Get("X-Hedged-Attempt") != "" {
+		t.Fatal("original request must not be modified")
+	}
+}
+
+func TestHedgeHead(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.Header().Set("Content-Length", "42")
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	const upto = 3
+	client, err := NewClientWithOptions(nil, WithTimeout(time.Millisecond), WithUpto(upto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Head(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != 42 {
+		t.Fatalf("want %v, got %v", 42, resp.ContentLength)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(methods) == upto
+	})
+	mu.Lock()
+	for _, m := range methods {
+		if m != http.MethodHead {
+			t.Fatalf("want %v, got %v", http.MethodHead, m)
+		}
+	}
+	mu.Unlock()
+
+	// transport which returns a body blocking on read must not block draining of lost responses
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: blockingBody{}, Request: req}, nil
+	})
+	mw, err := NewMiddleware(WithUpto(upto), WithImmediateFanout(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ht := mw(rt)
+	req, err := http.NewRequest(http.MethodHead, url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = ht.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ht.(*hedgedTransport).Shutdown(ctx); err != nil {
+		t.Fatalf("discarded HEAD responses are not closed: %v", err)
+	}
+}
+
+// blockingBody blocks on Read forever.
+type blockingBody struct{}
+
+func (blockingBody) Read([]byte) (int, error) { select {} }
+
+func (blockingBody) Close() error { return nil }
+
+func TestHostRotation(t *testing.T) {
+	const upto = 3
+	gotHosts := make(chan string, upto)
+
+	hosts := make([]string, upto)
+	for i := range hosts {
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			gotHosts <- r.Host
+			time.Sleep(50 * time.Millisecond)
+		})
+		hosts[i] = strings.TrimPrefix(url, "http://")
+	}
+
+	req, err := http.NewRequest("GET", "http://"+hosts[0], http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(upto),
+		WithHostRotation(hosts),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < upto; i++ {
+		if got := <-gotHosts; got != hosts[i] {
+			t.Fatalf("attempt %d: want host %v, got %v", i, hosts[i], got)
+		}
+	}
+}
+
+func TestHostRotationSkipsFailedHosts(t *testing.T) {
+	hosts := []string{"a.example.com", "b.example.com", "c.example.com"}
+	testCases := []struct {
+		name       string
+		failing    map[string]bool
+		wantCounts map[string]int
+		wantErrs   int
+	}{
+		// attempt 4 would be sent to b
+		{"one failed", map[string]bool{"b.example.com": true}, map[string]int{"a.example.com": 2, "b.example.com": 1, "c.example.com": 2}, 0},
+		{"all failed", map[string]bool{"a.example.com": true, "b.example.com": true, "c.example.com": true}, map[string]int{"a.example.com": 1, "b.example.com": 1, "c.example.com": 1}, 3},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // requests in flight outlive the round trip
+		var mu sync.Mutex
+		counts := map[string]int{}
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			counts[req.URL.Host]++
+			mu.Unlock()
+			if tc.failing[req.URL.Host] {
+				return nil, errors.New("connection refused")
+			}
+			time.Sleep(50 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		})
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(5*time.Millisecond),
+			WithUpto(5),
+			WithHostRotation(hosts),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Get("http://example.com")
+		if tc.wantErrs > 0 {
+			var hedgedErr *HedgedError
+			if !errors.As(err, &hedgedErr) || len(hedgedErr.Errors) != tc.wantErrs {
+				t.Fatalf("%s: want %d errors, got %v", tc.name, tc.wantErrs, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		mu.Lock()
+		if !reflect.DeepEqual(counts, tc.wantCounts) {
+			t.Fatalf("%s: want %v, got %v", tc.name, tc.wantCounts, counts)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTargetURLs(t *testing.T) {
+	const upto = 3
+	type arrival struct {
+		attempt, method, uri, body, token string
+	}
+	arrivals := make(chan arrival, upto)
+
+	base := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		arrivals <- arrival{
+			attempt: r.Header.Get("X-Attempt"),
+			method:  r.Method,
+			uri:     r.URL.RequestURI(),
+			body:    string(body),
+			token:   r.Header.Get("X-Token"),
+		}
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	var urls []*url.URL
+	for _, target := range []string{base + "/shard/0?q=a", base + "/shard/1?q=b"} {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	req, err := http.NewRequest("PUT", base+"/original", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Token", "secret")
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(upto),
+		WithHedgeHeader("X-Attempt"),
+		WithTargetURLs(urls),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := map[string]arrival{}
+	for i := 0; i < upto; i++ {
+		a := <-arrivals
+		got[a.attempt] = a
+	}
+	for i := 0; i < upto; i++ {
+		want := arrival{
+			attempt: strconv.Itoa(i),
+			method:  "PUT",
+			uri:     urls[i%len(urls)].RequestURI(),
+			body:    "payload",
+			token:   "secret",
+		}
+		if got[want.attempt] != want {
+			t.Fatalf("attempt %d: want %+v, got %+v", i, want, got[want.attempt])
+		}
+	}
+	if req.URL.Path != "/original" {
+		t.Fatalf("original request is modified: %v", req.URL)
+	}
+}
+
+func TestTargetURLsInvalid(t *testing.T) {
+	_, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithTargetURLs([]*url.URL{{Path: "/relative"}}),
+	)
+	if err == nil || !strings.Contains(err.Error(), "absolute") {
+		t.Fatalf("want absolute URL error, got %v", err)
+	}
+
+	_, err = NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithHostRotation([]string{"a.example.com"}),
+		WithTargetURLs([]*url.URL{{Scheme: "http", Host: "b.example.com"}}),
+	)
+	if err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("want mutually exclusive error, got %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	type arrival struct {
+		host string
+		at   time.Time
+	}
+	arrivals := make(chan arrival, 4)
+
+	primary := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		arrivals <- arrival{host: r.Host, at: time.Now()}
+		time.Sleep(200 * time.Millisecond)
+	})
+	backup := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		arrivals <- arrival{host: r.Host, at: time.Now()}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	backupHost := strings.TrimPrefix(backup, "http://")
+
+	stats := &Stats{}
+	client, err := NewClientWithOptions(nil,
+		WithUpto(5),
+		WithBackup(backupHost, delay, time.Second),
+		WithStats(stats),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want response from backup, got status %v", resp.StatusCode)
+	}
+
+	first, second := <-arrivals, <-arrivals
+	if want := strings.TrimPrefix(primary, "http://"); first.host != want {
+		t.Fatalf("want primary host %v, got %v", want, first.host)
+	}
+	if second.host != backupHost {
+		t.Fatalf("want backup host %v, got %v", backupHost, second.host)
+	}
+	if gap := second.at.Sub(first.at); gap < delay {
+		t.Fatalf("want backup sent after %v, got %v", delay, gap)
+	}
+	if got := stats.ActualRoundTrips(); got != 2 {
+		t.Fatalf("want 2 requests regardless of upto, got %v", got)
+	}
+
+	checkSchedule(t, []time.Duration{delay}, WithUpto(5), WithBackup(backupHost, delay, time.Second))
+}
+
+func TestBackupTimeout(t *testing.T) {
+	primary := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	backup := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithBackup(strings.TrimPrefix(backup, "http://"), 10*time.Millisecond, 20*time.Millisecond),
+		WithPerAttemptTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want response from primary, got status %v", resp.StatusCode)
+	}
+}
+
+func TestBackupInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    []Option
+		wantErr string
+	}{
+		{"empty host", []Option{WithBackup("", time.Millisecond, 0)}, "backup host cannot be empty"},
+		{"negative delay", []Option{WithBackup("localhost", -time.Millisecond, 0)}, "backup delay and per attempt timeout must be >= 0"},
+		{"negative timeout", []Option{WithBackup("localhost", 0, -time.Millisecond)}, "backup delay and per attempt timeout must be >= 0"},
+		{"with timeout", []Option{WithTimeout(time.Millisecond), WithBackup("localhost", 0, 0)}, "mutually exclusive"},
+		{"with host rotation", []Option{WithHostRotation([]string{"a"}), WithBackup("localhost", 0, 0)}, "cannot be used with WithHostRotation"},
+	}
+	for _, tc := range testCases {
+		_, err := NewClientWithOptions(nil, tc.opts...)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: want error %q, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestMinRemainingBudget(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(20*time.Millisecond),
+		WithUpto(10),
+		WithMinRemainingBudget(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// requests at 0, 20ms and 40ms, the next one has less than 50ms left
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests < 2 || gotRequests > 3 {
+		t.Fatalf("want 2 or 3 requests, got %v", gotRequests)
+	}
+}
+
+func TestDiscardedResponsesReuseConnections(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") == "0" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(bytes.Repeat([]byte("a"), 512<<10))
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Second),
+		WithUpto(2),
+		WithDrainLimit(1<<20),
+		WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			req.Header.Set("X-Attempt", fmt.Sprint(attempt))
+			return req
+		}),
+		WithResponseValidator(func(resp *http.Response) bool {
+			return resp.StatusCode == http.StatusOK
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 20
+	var newConns, reusedConns int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&reusedConns, 1)
+			} else {
+				atomic.AddInt64(&newConns, 1)
+			}
+		},
+	}
+
+	for i := 0; i < requests; i++ {
+		ctx := httptrace.WithClientTrace(context.Background(), trace)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if newConns := atomic.LoadInt64(&newConns); newConns >= requests/2 {
+		t.Fatalf("want connections to be reused, got %v new and %v reused", newConns, atomic.LoadInt64(&reusedConns))
+	}
+}
+
+func TestDrainLimit(t *testing.T) {
+	if _, err := newConfig(WithUpto(1), WithDrainLimit(-1)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+	cfg, err := newConfig(WithUpto(1), WithDrainLimit(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &closeCounter{Reader: strings.NewReader(strings.Repeat("a", 100))}
+	drainBody(body, cfg.drainLimit)
+
+	if left, _ := io.ReadAll(body); len(left) != 90 {
+		t.Fatalf("want %v bytes left, got %v", 90, len(left))
+	}
+	if closed := atomic.LoadInt64(&body.closed); closed != 1 {
+		t.Fatalf("want body closed once, got %v", closed)
+	}
+}
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	var w latencyWindow
+	w.init(100)
+
+	for i := 1; i <= 99; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := w.percentile(90); ok {
+		t.Fatal("want no percentile until window is full")
+	}
+	w.add(100 * time.Millisecond)
+
+	for p, want := range map[float64]time.Duration{
+		50:  50 * time.Millisecond,
+		90:  90 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	} {
+		got, ok := w.percentile(p)
+		if !ok || got != want {
+			t.Fatalf("p%v: want %v, got %v", p, want, got)
+		}
+	}
+
+	// ring buffer overwrites the oldest samples
+	for i := 0; i < 100; i++ {
+		w.add(time.Second)
+	}
+	if got, _ := w.percentile(1); got != time.Second {
+		t.Fatalf("want %v, got %v", time.Second, got)
+	}
+}
+
+func TestFirstAttemptLatencyStats(t *testing.T) {
+	stats := &Stats{}
+	if min, mean, max := stats.FirstAttemptLatencyStats(); min != 0 || mean != 0 || max != 0 {
+		t.Fatalf("want zeros without samples, got %v %v %v", min, mean, max)
+	}
+
+	stats.firstAttemptLatency.init(4)
+	for _, d := range []time.Duration{30, 10, 20} {
+		stats.firstAttemptLatency.add(d * time.Millisecond)
+	}
+	if min, mean, max := stats.FirstAttemptLatencyStats(); min != 10*time.Millisecond || mean != 20*time.Millisecond || max != 30*time.Millisecond {
+		t.Fatalf("want 10ms 20ms 30ms, got %v %v %v", min, mean, max)
+	}
+
+	// ring buffer overwrites the oldest samples: 30ms and 10ms are gone
+	for _, d := range []time.Duration{40, 50, 60} {
+		stats.firstAttemptLatency.add(d * time.Millisecond)
+	}
+	if min, mean, max := stats.FirstAttemptLatencyStats(); min != 20*time.Millisecond || mean != 42500*time.Microsecond || max != 60*time.Millisecond {
+		t.Fatalf("want 20ms 42.5ms 60ms, got %v %v %v", min, mean, max)
+	}
+}
+
+func TestSharedStatsLatencyWindow(t *testing.T) {
+	clock := newFakeClock()
+	var latency time.Duration
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clock.Advance(latency)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+
+	stats := &Stats{}
+	mw, err := NewMiddleware(
+		WithUpto(2),
+		WithAdaptiveDelay(0.5),
+		WithAdaptiveSeed(time.Second, 4),
+		WithStats(stats),
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mw(rt)
+	for _, latency = range []time.Duration{10 * time.Millisecond, 30 * time.Millisecond} {
+		req, err := http.NewRequest("GET", "http://localhost", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := first.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// another transport with the same stats keeps the collected latencies
+	_ = mw(rt)
+	if min, mean, max := stats.FirstAttemptLatencyStats(); min != 10*time.Millisecond || mean != 20*time.Millisecond || max != 30*time.Millisecond {
+		t.Fatalf("want 10ms 20ms 30ms, got %v %v %v", min, mean, max)
+	}
+}
+
+func TestAdaptiveDelay(t *testing.T) {
+	const sleep = 20 * time.Millisecond
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(sleep)
+	})
+
+	stats := &Stats{}
+	client, err := NewClientWithOptions(nil,
+		WithUpto(2),
+		WithAdaptiveDelay(90),
+		WithAdaptiveSeed(5*time.Millisecond, 5),
+		WithStats(stats),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest("GET", url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if i == 0 {
+			if got := stats.AdaptiveDelay(); got != 5*time.Millisecond {
+				t.Fatalf("want seed delay, got %v", got)
+			}
+		}
+	}
+
+	if got := stats.AdaptiveDelay(); got < sleep || got > 10*sleep {
+		t.Fatalf("want delay close to %v, got %v", sleep, got)
+	}
+}
+
+func TestOnHedge(t *testing.T) {
+	const upto = 4
+	var hedged int64
+	attempts := make(chan int, upto)
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(upto),
+		WithOnHedge(func(r *http.Request, attempt int) {
+			if r == req || r.URL.String() != url {
+				t.Errorf("want request copy for %v, got %v", url, r.URL)
+			}
+			atomic.AddInt64(&hedged, 1)
+			attempts <- attempt
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if hedged := atomic.LoadInt64(&hedged); hedged != upto-1 {
+		t.Fatalf("want %v, got %v", upto-1, hedged)
+	}
+	seen := map[int]bool{}
+	for i := 0; i < upto-1; i++ {
+		seen[<-attempts] = true
+	}
+	for attempt := 1; attempt < upto; attempt++ {
+		if !seen[attempt] {
+			t.Fatalf("want attempt %v, got %v", attempt, seen)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	lines := make(chan string, 16)
+	logger := loggerFunc(func(format string, args ...interface{}) {
+		lines <- fmt.Sprintf(format, args...)
+	})
+
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("X-Attempt") == "0" {
+			time.Sleep(30 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			req.Header.Set("X-Attempt", strconv.Itoa(attempt))
+			return req
+		}),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := map[string]bool{
+		"hedgedhttp: attempt 0 started after 0s":    true,
+		"hedgedhttp: attempt 1 started after 5ms":   true,
+		"hedgedhttp: attempt 0 won with status 200": true,
+		"hedgedhttp: attempt 1 canceled":            true,
+	}
+	for len(want) > 0 {
+		select {
+		case line := <-lines:
+			if !want[line] {
+				t.Fatalf("unexpected log line %q", line)
+			}
+			delete(want, line)
+		case <-time.After(time.Second):
+			t.Fatalf("want log lines %v", want)
+		}
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	NewStdLogger(log.New(&buf, "", 0)).Logf("attempt %d", 1)
+	if got := buf.String(); got != "attempt 1\n" {
+		t.Fatalf("want %q, got %q", "attempt 1\n", got)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	replica := func(body string, sleep time.Duration) string {
+		return strings.TrimPrefix(testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(sleep)
+			io.WriteString(w, body)
+		}), "http://")
+	}
+	equalBodies := func(a, b *http.Response) bool {
+		bodyA, errA := io.ReadAll(a.Body)
+		bodyB, errB := io.ReadAll(b.Body)
+		return errA == nil && errB == nil && bytes.Equal(bodyA, bodyB)
+	}
+
+	testCases := []struct {
+		name  string
+		hosts []string
+		want  string
+	}{
+		{"two agree", []string{replica("stale", 0), replica("fresh", 20*time.Millisecond), replica("fresh", 40*time.Millisecond)}, "fresh"},
+		{"no agreement", []string{replica("a", 0), replica("b", 10*time.Millisecond), replica("c", 20*time.Millisecond)}, "a"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClientWithOptions(nil,
+				WithTimeout(5*time.Millisecond),
+				WithUpto(3),
+				WithHostRotation(tc.hosts),
+				WithQuorum(2, equalBodies),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get("http://" + tc.hosts[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, body)
+			}
+		})
+	}
+}
+
+func TestQuorumDecodedBodyEqual(t *testing.T) {
+	const payload = "same payload"
+
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	io.WriteString(gw, payload)
+	gw.Close()
+	zw, _ := zlib.NewWriterLevel(&deflated, zlib.BestCompression)
+	io.WriteString(zw, payload)
+	zw.Close()
+
+	replica := func(encoding string, body []byte, sleep time.Duration) string {
+		return strings.TrimPrefix(testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(sleep)
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			w.Write(body)
+		}), "http://")
+	}
+
+	testCases := []struct {
+		name  string
+		hosts []string
+	}{
+		{"gzip and plain", []string{replica("", []byte("stale"), 0), replica("gzip", gzipped.Bytes(), 10*time.Millisecond), replica("", []byte(payload), 20*time.Millisecond)}},
+		{"gzip and deflate", []string{replica("", []byte("stale"), 0), replica("gzip", gzipped.Bytes(), 10*time.Millisecond), replica("deflate", deflated.Bytes(), 20*time.Millisecond)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewClientWithOptions(nil,
+				WithTimeout(5*time.Millisecond),
+				WithUpto(3),
+				WithHostRotation(tc.hosts),
+				WithQuorum(2, DecodedBodyEqual),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest("GET", "http://"+tc.hosts[0], http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// explicit header disables transparent decompression of the transport
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, err := decodedBody(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != payload {
+				t.Fatalf("want %q, got %q", payload, body)
+			}
+		})
+	}
+}
+
+func TestDecodedBodyEqualInvalid(t *testing.T) {
+	resp := func(encoding, body string) *http.Response {
+		return &http.Response{
+			Header: http.Header{"Content-Encoding": []string{encoding}},
+			Body:   io.NopCloser(strings.NewReader(body)),
+		}
+	}
+	if DecodedBodyEqual(resp("gzip", "not gzip"), resp("gzip", "not gzip")) {
+		t.Fatal("want corrupted bodies to be not equal")
+	}
+	if DecodedBodyEqual(resp("br", "a"), resp("br", "a")) {
+		t.Fatal("want bodies with unsupported encoding to be not equal")
+	}
+}
+
+func TestQuorumBodyLimit(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "too large")
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithQuorum(2, func(a, b *http.Response) bool { return true }),
+		WithQuorumBodyLimit(3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "too large" {
+		t.Fatalf("want %q, got %q", "too large", body)
+	}
+}
+
+func TestRequestOverrides(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Second),
+		WithUpto(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithRequestTimeout(context.Background(), 5*time.Millisecond)
+	ctx = WithRequestUpto(ctx, 4)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if passed := time.Since(start); passed > 500*time.Millisecond {
+		t.Fatalf("want request timeout override, took %v", passed)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 4 {
+		t.Fatalf("want %v, got %v", 4, gotRequests)
+	}
+}
+
+func TestWithoutHedging(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	stats := &Stats{}
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Millisecond),
+		WithUpto(5),
+		WithImmediateFanout(true),
+		WithStats(stats),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(WithoutHedging(context.Background()), "GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+	if got := stats.RequestedRoundTrips(); got != 1 {
+		t.Fatalf("want %v, got %v", 1, got)
+	}
+	if got := stats.ActualRoundTrips(); got != 1 {
+		t.Fatalf("want %v, got %v", 1, got)
+	}
+}
+
+func TestInvalidUptoAndTimeout(t *testing.T) {
+	testCases := []struct {
+		timeout time.Duration
+		upto    int
+		wantErr string
+	}{
+		{0, 1, ""},
+		{time.Millisecond, 1, ""},
+		{0, 0, "hedgedhttp: upto must be >= 1"},
+		{0, -1, "hedgedhttp: upto must be >= 1"},
+		{-time.Nanosecond, 1, "hedgedhttp: timeout must be >= 0"},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewClientWithOptions(nil, WithTimeout(tc.timeout), WithUpto(tc.upto))
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Fatalf("timeout %v, upto %v: want error %q, got %v", tc.timeout, tc.upto, tc.wantErr, err)
+		}
+
+		_, err = NewRoundTripper(tc.timeout, tc.upto, nil)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Fatalf("timeout %v, upto %v: want error %q, got %v", tc.timeout, tc.upto, tc.wantErr, err)
+		}
+
+		_, _, err = NewClientAndStats(tc.timeout, tc.upto, nil)
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Fatalf("timeout %v, upto %v: want error %q, got %v", tc.timeout, tc.upto, tc.wantErr, err)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	clients := make(chan *http.Client, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(clients); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clients <- Default()
+		}()
+	}
+	wg.Wait()
+	close(clients)
+
+	first := <-clients
+	for client := range clients {
+		if client != first {
+			t.Fatal("want the same default client")
+		}
+	}
+	if _, ok := first.Transport.(*hedgedTransport); !ok {
+		t.Fatalf("want hedged transport, got %T", first.Transport)
+	}
+
+	custom := &http.Client{}
+	SetDefault(custom)
+	defer SetDefault(nil)
+	if got := Default(); got != custom {
+		t.Fatal("want client set by SetDefault")
+	}
+}
+
+func TestNewClientClampsUptoAndTimeout(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+	})
+
+	client := NewClient(-time.Second, 0, nil)
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+}
+
+func TestMultipleTracers(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	var events [2][]string
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Second),
+		WithUpto(2),
+		WithTracer(&recordingTracer{events: &events[0]}),
+		WithTracer(&recordingTracer{events: &events[1]}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	want := []string{"start", "attempt 0", "attempt 0 won", "end 0"}
+	for i, got := range events {
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Fatalf("tracer %d: want %v, got %v", i, want, got)
+		}
+	}
+}
+
 func TestNoTimeout(t *testing.T) {
 	const sleep = 10 * time.Millisecond
 	var gotRequests int64
@@ -64,6 +5323,17 @@ func TestNoTimeout(t *testing.T) {
 	}
 }
 
+func TestNoTimeoutSchedule(t *testing.T) {
+	const upto = 10
+
+	// zero timeout means the smallest possible delay between requests
+	delays := make([]time.Duration, upto-1)
+	for i := range delays {
+		delays[i] = time.Nanosecond
+	}
+	checkSchedule(t, delays, WithTimeout(0), WithUpto(upto))
+}
+
 func TestFirstIsOK(t *testing.T) {
 	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -135,67 +5405,582 @@ func TestGetSuccessEvenWithErrorsPresent(t *testing.T) {
 			return
 		}
 
-		conn, _, err := w.(http.Hijacker).Hijack()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = conn.Close() // emulate error by closing connection on client side
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewClient(10*time.Millisecond, 5, nil).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected resp status code: %+v", resp.StatusCode)
+	}
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(respBytes, []byte("success")) {
+		t.Fatalf("Unexpected resp body %+v; as string: %+v", respBytes, string(respBytes))
+	}
+}
+
+func TestGetFailureAfterAllRetries(t *testing.T) {
+	const upto = 5
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = conn.Close() // emulate error by closing connection on client side
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewClient(time.Millisecond, upto, nil).Do(req)
+	if err == nil {
+		t.Fatal(err)
+	}
+	if resp != nil {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+
+	wantErrStr := fmt.Sprintf(`%d errors occurred:`, upto)
+	if !strings.Contains(err.Error(), wantErrStr) {
+		t.Fatalf("Unexpected err %+v", err)
+	}
+}
+
+func TestNonRetryableError(t *testing.T) {
+	var gotRequests int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = conn.Close() // emulate error by closing connection on client side
+	})
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(50*time.Millisecond),
+		WithUpto(5),
+		WithErrorClassifier(func(err error) bool { return false }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if resp != nil {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+
+	var hedgedErr *HedgedError
+	if errors.As(err, &hedgedErr) {
+		t.Fatalf("want single error, got %+v", err)
+	}
+	if gotRequests := atomic.LoadInt64(&gotRequests); gotRequests != 1 {
+		t.Fatalf("want %v, got %v", 1, gotRequests)
+	}
+}
+
+func TestWeightedHosts(t *testing.T) {
+	const requests = 2000
+	var mu sync.Mutex
+	gotHosts := map[string]int{}
+
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "original" {
+			return nil, errors.New("failed")
+		}
+		mu.Lock()
+		gotHosts[req.URL.Host]++
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(time.Second),
+		WithUpto(2),
+		WithWeightedHosts(map[string]int{"a": 3, "b": 1}),
+		WithJitterSeed(42),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get("http://original")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if gotHosts["a"]+gotHosts["b"] != requests {
+		t.Fatalf("want %v hedged requests, got %v", requests, gotHosts)
+	}
+	if share := float64(gotHosts["a"]) / requests; share < 0.7 || share > 0.8 {
+		t.Fatalf("want about 75%% of requests to host a, got %v", gotHosts)
+	}
+}
+
+func TestWeightedHostsInvalid(t *testing.T) {
+	testCases := []Option{
+		WithWeightedHosts(map[string]int{"a": 0}),
+		WithWeightedHosts(map[string]int{"": 1}),
+	}
+	for _, opt := range testCases {
+		if _, err := NewClientWithOptions(nil, WithUpto(2), opt); err == nil {
+			t.Fatal("want error, got nil")
+		}
+	}
+
+	_, err := NewClientWithOptions(nil, WithUpto(2),
+		WithHostRotation([]string{"a"}),
+		WithWeightedHosts(map[string]int{"b": 1}),
+	)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestMaxHedgeableContentLength(t *testing.T) {
+	var gotRequests int64
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&gotRequests, 1)
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	const upto = 3
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(time.Millisecond),
+		WithUpto(upto),
+		WithMaxHedgeableContentLength(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streaming := func(s string) *http.Request {
+		req, err := http.NewRequest("PUT", url, io.NopCloser(strings.NewReader(s)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1
+		return req
+	}
+	withGetBody := streaming("small")
+	withGetBody.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("small")), nil }
+
+	testCases := []struct {
+		name string
+		req  func() *http.Request
+		want int64
+	}{
+		{"large declared length", func() *http.Request {
+			req, _ := http.NewRequest("PUT", url, strings.NewReader(strings.Repeat("x", 1000)))
+			return req
+		}, 1},
+		{"small declared length", func() *http.Request {
+			req, _ := http.NewRequest("PUT", url, strings.NewReader("small"))
+			return req
+		}, upto},
+		{"unknown length", func() *http.Request { return withGetBody }, 1},
+		{"unknown length buffered", func() *http.Request { return streaming("small") }, upto},
+		{"unknown length buffered large", func() *http.Request { return streaming(strings.Repeat("x", 1000)) }, 1},
+	}
+	for _, tc := range testCases {
+		atomic.StoreInt64(&gotRequests, 0)
+		resp, err := client.Do(tc.req())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		time.Sleep(30 * time.Millisecond) // wait for canceled requests
+		if got := atomic.LoadInt64(&gotRequests); got != tc.want {
+			t.Fatalf("%s: want %v requests, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	if _, err := NewClientWithOptions(nil, WithUpto(2), WithMaxHedgeableContentLength(-1)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestGetBodyFailure(t *testing.T) {
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Error(err)
 		}
-		_ = conn.Close() // emulate error by closing connection on client side
+		time.Sleep(30 * time.Millisecond)
 	})
 
-	req, err := http.NewRequest("GET", url, http.NoBody)
+	client, err := NewClientWithOptions(nil,
+		WithTimeout(5*time.Millisecond),
+		WithUpto(3),
+		WithErrorClassifier(func(err error) bool { return false }),
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	resp, err := NewClient(10*time.Millisecond, 5, nil).Do(req)
+	var calls int64
+	req, err := http.NewRequest("PUT", url, strings.NewReader("body"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		t.Fatalf("Unexpected resp status code: %+v", resp.StatusCode)
+	req.GetBody = func() (io.ReadCloser, error) {
+		if atomic.AddInt64(&calls, 1) > 1 {
+			return nil, errors.New("file removed")
+		}
+		return io.NopCloser(strings.NewReader("body")), nil
 	}
 
-	respBytes, err := ioutil.ReadAll(resp.Body)
+	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !bytes.Equal(respBytes, []byte("success")) {
-		t.Fatalf("Unexpected resp body %+v; as string: %+v", respBytes, string(respBytes))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Fatalf("want %v GetBody calls, got %v", 2, got)
 	}
 }
 
-func TestGetFailureAfterAllRetries(t *testing.T) {
-	const upto = 5
+func TestErrorAggregation(t *testing.T) {
+	errFirst, errLast := errors.New("first"), errors.New("last")
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := AttemptIndex(&http.Response{Request: req})
+		if idx == 0 {
+			time.Sleep(20 * time.Millisecond)
+			return nil, errLast
+		}
+		return nil, errFirst
+	})
 
-	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
-		conn, _, err := w.(http.Hijacker).Hijack()
+	testCases := []struct {
+		mode ErrorAggregation
+		want error
+	}{
+		{AggregateAll, nil},
+		{FirstError, errFirst},
+		{LastError, errLast},
+	}
+	for _, tc := range testCases {
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(time.Millisecond),
+			WithUpto(2),
+			WithErrorAggregation(tc.mode),
+		)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			t.Fatal(err)
 		}
-		_ = conn.Close() // emulate error by closing connection on client side
+		_, err = client.Get("http://localhost")
+
+		var hedgedErr *HedgedError
+		switch {
+		case tc.want == nil:
+			if !errors.As(err, &hedgedErr) || len(hedgedErr.Errors) != 2 {
+				t.Fatalf("mode %v: want HedgedError with 2 errors, got %v", tc.mode, err)
+			}
+		case errors.As(err, &hedgedErr):
+			t.Fatalf("mode %v: want a single error, got %v", tc.mode, err)
+		case !errors.Is(err, tc.want):
+			t.Fatalf("mode %v: want %v, got %v", tc.mode, tc.want, err)
+		}
+	}
+
+	if _, err := NewClientWithOptions(nil, WithUpto(2), WithErrorAggregation(LastError+1)); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestHedgedErrorUnwrap(t *testing.T) {
+	const upto = 5
+	var gotRequests int64
+	errBoom := errors.New("boom")
+
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt64(&gotRequests, 1) == 3 {
+			return nil, fmt.Errorf("attempt failed: %w", context.DeadlineExceeded)
+		}
+		return nil, errBoom
 	})
 
-	req, err := http.NewRequest("GET", url, http.NoBody)
+	req, err := http.NewRequest("GET", "http://example.com", http.NoBody)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	resp, err := NewClient(time.Millisecond, upto, nil).Do(req)
+	client := NewClient(time.Millisecond, upto, &http.Client{Transport: base})
+	_, err = client.Do(req)
 	if err == nil {
-		t.Fatal(err)
+		t.Fatal("want error, got nil")
 	}
-	if resp != nil {
-		t.Fatalf("Unexpected response %+v", resp)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v in %v", context.DeadlineExceeded, err)
+	}
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("want %v in %v", errBoom, err)
 	}
 
+	var hedgedErr *HedgedError
+	if !errors.As(err, &hedgedErr) {
+		t.Fatalf("want HedgedError, got %T", err)
+	}
+	if len(hedgedErr.Errors) != upto {
+		t.Fatalf("want %v errors, got %v", upto, len(hedgedErr.Errors))
+	}
 	wantErrStr := fmt.Sprintf(`%d errors occurred:`, upto)
 	if !strings.Contains(err.Error(), wantErrStr) {
 		t.Fatalf("Unexpected err %+v", err)
 	}
 }
 
+func TestHedgedErrorTimeout(t *testing.T) {
+	errBoom := errors.New("boom")
+	testCases := []struct {
+		name          string
+		errs          []error
+		wantTimeout   bool
+		wantTemporary bool
+	}{
+		{"all timeouts", []error{timeoutError{temporary: true}, fmt.Errorf("attempt failed: %w", timeoutError{temporary: true})}, true, true},
+		{"timeouts and deadline", []error{timeoutError{}, context.DeadlineExceeded}, true, false},
+		{"mixed", []error{timeoutError{temporary: true}, errBoom}, false, false},
+		{"no timeouts", []error{errBoom, errBoom}, false, false},
+	}
+
+	for _, tc := range testCases {
+		var gotRequests int64
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			n := atomic.AddInt64(&gotRequests, 1)
+			return nil, tc.errs[int(n-1)%len(tc.errs)]
+		})
+		client, err := NewClientWithOptions(&http.Client{Transport: rt},
+			WithTimeout(time.Millisecond),
+			WithUpto(len(tc.errs)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Get("http://example.com")
+		// *url.Error returned by the client reports Timeout of the wrapped error
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			t.Fatalf("%s: want net.Error, got %T", tc.name, err)
+		}
+		if got := netErr.Timeout(); got != tc.wantTimeout {
+			t.Fatalf("%s: want timeout %v, got %v", tc.name, tc.wantTimeout, got)
+		}
+		var hedgedErr *HedgedError
+		if !errors.As(err, &hedgedErr) {
+			t.Fatalf("%s: want HedgedError, got %T", tc.name, err)
+		}
+		if got := hedgedErr.Temporary(); got != tc.wantTemporary {
+			t.Fatalf("%s: want temporary %v, got %v", tc.name, tc.wantTemporary, got)
+		}
+	}
+
+	if empty := (&HedgedError{}); empty.Timeout() || empty.Temporary() {
+		t.Fatal("want no timeout for no errors")
+	}
+}
+
+type timeoutError struct {
+	temporary bool
+}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return e.temporary }
+
+func TestHedgedErrorAttempts(t *testing.T) {
+	failures := []error{
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+		tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+		fmt.Errorf("read response: %w", context.DeadlineExceeded),
+		&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true},
+		errors.New("remote error: tls: handshake failure"),
+		errors.New("boom"),
+	}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		idx, _ := req.Context().Value(attemptIndexKey{}).(int)
+		return nil, failures[idx]
+	})
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(5*time.Millisecond),
+		WithUpto(len(failures)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get("http://example.com")
+	var hedgedErr *HedgedError
+	if !errors.As(err, &hedgedErr) {
+		t.Fatalf("want HedgedError, got %v", err)
+	}
+	want := []AttemptError{
+		{Index: 0, Err: failures[0], Category: CategoryDial},
+		{Index: 1, Err: failures[1], Category: CategoryTLS},
+		{Index: 2, Err: failures[2], Category: CategoryTimeout},
+		{Index: 3, Err: failures[3], Category: CategoryDial},
+		{Index: 4, Err: failures[4], Category: CategoryTLS},
+		{Index: 5, Err: failures[5], Category: CategoryOther},
+	}
+	if got := hedgedErr.Attempts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	// a response rejected before the budget has expired is listed with its status
+	rt = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx == 0 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+		}
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	client, err = NewClientWithOptions(&http.Client{Transport: rt},
+		WithTimeout(5*time.Millisecond),
+		WithUpto(2),
+		WithLatencyBudget(30*time.Millisecond),
+		WithResponseValidator(func(resp *http.Response) bool { return resp.StatusCode < 500 }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get("http://example.com")
+	var budgetErr *LatencyBudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("want LatencyBudgetError, got %v", err)
+	}
+	want = []AttemptError{{Index: 0, StatusCode: http.StatusServiceUnavailable, Category: CategoryStatusRejected}}
+	if got := budgetErr.Attempts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	// errors of an error which is not returned by the transport have no index
+	errCanceled := fmt.Errorf("attempt: %w", context.Canceled)
+	want = []AttemptError{{Index: -1, Err: errCanceled, Category: CategoryCanceled}}
+	if got := (&HedgedError{Errors: []error{errCanceled}}).Attempts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestRedirectPropagation(t *testing.T) {
+	newServer := func(t *testing.T, canceled *int32) string {
+		return testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/new":
+				fmt.Fprint(w, "new")
+			case r.Header.Get("X-Attempt") == "0":
+				select {
+				case <-time.After(100 * time.Millisecond):
+					fmt.Fprint(w, "stale")
+				case <-r.Context().Done():
+					atomic.AddInt32(canceled, 1)
+				}
+			default:
+				http.Redirect(w, r, "/new", http.StatusFound)
+			}
+		})
+	}
+	get := func(t *testing.T, url string, checkRedirect func(*http.Request, []*http.Request) error, opts ...Option) (*http.Response, string) {
+		opts = append([]Option{
+			WithTimeout(10 * time.Millisecond),
+			WithUpto(2),
+			WithHedgeHeader("X-Attempt"),
+			WithSelectionPolicy(PolicyFirstSuccess),
+		}, opts...)
+		client, err := NewClientWithOptions(nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.CheckRedirect = checkRedirect
+		resp, err := client.Get(url + "/old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(body)
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		var canceled int32
+		url := newServer(t, &canceled)
+		resp, body := get(t, url, nil, WithRedirectPropagation(true))
+		if body != "new" {
+			t.Fatalf("want body %q, got %q", "new", body)
+		}
+		if resp.Request.URL.Path != "/new" {
+			t.Fatalf("want final URL %q, got %q", "/new", resp.Request.URL.Path)
+		}
+		waitFor(t, func() bool { return atomic.LoadInt32(&canceled) == 1 })
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var canceled int32
+		url := newServer(t, &canceled)
+		resp, body := get(t, url, nil)
+		if body != "stale" {
+			t.Fatalf("want body %q, got %q", "stale", body)
+		}
+		if resp.Request.URL.Path != "/old" {
+			t.Fatalf("want URL %q, got %q", "/old", resp.Request.URL.Path)
+		}
+	})
+
+	t.Run("use last response", func(t *testing.T) {
+		var canceled int32
+		url := newServer(t, &canceled)
+		useLast := func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		resp, _ := get(t, url, useLast, WithRedirectPropagation(true))
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("want status %v, got %v", http.StatusFound, resp.StatusCode)
+		}
+		if loc := resp.Header.Get("Location"); loc != "/new" {
+			t.Fatalf("want Location %q, got %q", "/new", loc)
+		}
+	})
+}
+
 func TestHangAllExceptLast(t *testing.T) {
 	const upto = 5
 	var gotRequests uint64
@@ -253,12 +6038,359 @@ func TestCancelByClient(t *testing.T) {
 	}
 }
 
+func TestCancelPropagatesToAllRequests(t *testing.T) {
+	const upto = 3
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+
+	testCases := map[string]func(req *http.Request, cancel func()) *http.Request{
+		"context": func(req *http.Request, cancel func()) *http.Request {
+			ctx, cancelCtx := context.WithCancel(req.Context())
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+				cancelCtx()
+			}()
+			return req.WithContext(ctx)
+		},
+		"cancel channel": func(req *http.Request, cancel func()) *http.Request {
+			ch := make(chan struct{})
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+				close(ch)
+			}()
+			req.Cancel = ch // deprecated, but still must be honored
+			return req
+		},
+	}
+
+	for name, withCancel := range testCases {
+		var canceledAt sync.Map
+		var started int64
+		url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+			idx := atomic.AddInt64(&started, 1)
+			select {
+			case <-r.Context().Done():
+				canceledAt.Store(idx, time.Now())
+			case <-blockCh:
+			}
+		})
+
+		req, err := http.NewRequest("GET", url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cancelTime atomic.Value
+		req = withCancel(req, func() { cancelTime.Store(time.Now()) })
+
+		if _, err := NewClient(10*time.Millisecond, upto, nil).Do(req); err == nil {
+			t.Fatalf("%s: want error, got nil", name)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			n := 0
+			canceledAt.Range(func(_, _ interface{}) bool { n++; return true })
+			if n == upto {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		canceled := cancelTime.Load().(time.Time)
+		for idx := int64(1); idx <= upto; idx++ {
+			at, ok := canceledAt.Load(idx)
+			if !ok {
+				t.Fatalf("%s: request %d is not canceled", name, idx)
+			}
+			if d := at.(time.Time).Sub(canceled); d > 50*time.Millisecond {
+				t.Fatalf("%s: request %d is canceled after %v", name, idx, d)
+			}
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+	var canceled int64
+
+	url := testServerURL(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt64(&canceled, 1)
+		case <-blockCh:
+		}
+	})
+
+	rt, err := NewRoundTripper(5*time.Millisecond, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+
+	errCh := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest("GET", url, http.NoBody)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = client.Do(req)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdowner := rt.(interface{ Shutdown(context.Context) error })
+	if err := shutdowner.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errCh; !errors.Is(err, ErrShutdown) {
+		t.Fatalf("want %v, got %v", ErrShutdown, err)
+	}
+
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("want %v, got %v", ErrShutdown, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if canceled := atomic.LoadInt64(&canceled); canceled != 3 {
+		t.Fatalf("want %v canceled requests, got %v", 3, canceled)
+	}
+}
+
+func TestDiscardSlowBodies(t *testing.T) {
+	const losers, maxDrains = 6, 2
+	var draining int32
+	var mu sync.Mutex
+	var bodies []*closeCounter
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx == losers {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}
+		// a large body which is read only until the request is canceled
+		pr, pw := io.Pipe()
+		go func() {
+			if _, err := pw.Write([]byte("x")); err == nil {
+				atomic.AddInt32(&draining, 1)
+			}
+			<-req.Context().Done()
+			pw.CloseWithError(req.Context().Err())
+		}()
+		body := &closeCounter{Reader: pr}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: body}, nil
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithUpto(losers+1),
+		WithImmediateFanout(true),
+		WithMaxConcurrentDrains(maxDrains),
+		WithSelectorMode(SelectOnAllDone),
+		WithResponseSelector(func(candidates []*http.Response) int {
+			for i, resp := range candidates {
+				if resp.StatusCode == http.StatusOK {
+					return i
+				}
+			}
+			return -1
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("want winner returned at once, got after %v", elapsed)
+	}
+
+	// other bodies wait in the queue, none is closed without draining
+	waitFor(t, func() bool { return atomic.LoadInt32(&draining) == maxDrains })
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&draining); got != maxDrains {
+		t.Fatalf("want %v bodies drained at once, got %v", maxDrains, got)
+	}
+	countClosed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		closed := 0
+		for _, b := range bodies {
+			closed += int(atomic.LoadInt64(&b.closed))
+		}
+		return closed
+	}
+	if got := countClosed(); got != 0 {
+		t.Fatalf("want no closed bodies, got %v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdowner := client.Transport.(interface{ Shutdown(context.Context) error })
+	if err := shutdowner.Shutdown(ctx); err != nil {
+		t.Fatalf("want drains aborted by shutdown, got %v", err)
+	}
+	if got := countClosed(); got != losers {
+		t.Fatalf("want %v closed bodies, got %v", losers, got)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	const losers = 4
+	var mu sync.Mutex
+	var bodies []*closeCounter
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if idx, _ := req.Context().Value(attemptIndexKey{}).(int); idx == losers {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}
+		// a body which never ends, like a long poll, until the request is canceled
+		pr, pw := io.Pipe()
+		go func() {
+			<-req.Context().Done()
+			pw.CloseWithError(req.Context().Err())
+		}()
+		body := &closeCounter{Reader: pr}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: body}, nil
+	})
+
+	client, err := NewClientWithOptions(&http.Client{Transport: rt},
+		WithUpto(losers+1),
+		WithImmediateFanout(true),
+		WithMaxConcurrentDrains(1),
+		WithDrainTimeout(20*time.Millisecond),
+		WithSelectorMode(SelectOnAllDone),
+		WithResponseSelector(func(candidates []*http.Response) int {
+			for i, resp := range candidates {
+				if resp.StatusCode == http.StatusOK {
+					return i
+				}
+			}
+			return -1
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClientWithOptions(nil, WithUpto(2), WithDrainTimeout(0)); err == nil {
+		t.Fatal("want error for zero drain timeout")
+	}
+
+	resp, err := client.Get("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the queue makes progress without Shutdown
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		closed := 0
+		for _, b := range bodies {
+			closed += int(atomic.LoadInt64(&b.closed))
+		}
+		return closed == losers
+	})
+}
+
 func testServerURL(t *testing.T, h func(http.ResponseWriter, *http.Request)) string {
 	server := httptest.NewServer(http.HandlerFunc(h))
 	t.Cleanup(server.Close)
 	return server.URL
 }
 
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return fn(req) }
+
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+type loggerFunc func(format string, args ...interface{})
+
+func (fn loggerFunc) Logf(format string, args ...interface{}) { fn(format, args...) }
+
+type recordingTracer struct {
+	events *[]string
+}
+
+func (r *recordingTracer) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	*r.events = append(*r.events, "start")
+	return ctx, r
+}
+
+func (r *recordingTracer) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, AttemptSpan) {
+	*r.events = append(*r.events, fmt.Sprintf("attempt %d", attempt))
+	return ctx, recordingAttempt{r: r, attempt: attempt}
+}
+
+func (r *recordingTracer) End(winner int, err error) {
+	*r.events = append(*r.events, fmt.Sprintf("end %d", winner))
+}
+
+type recordingAttempt struct {
+	r       *recordingTracer
+	attempt int
+}
+
+func (a recordingAttempt) End(outcome AttemptOutcome, resp *http.Response, err error) {
+	*a.r.events = append(*a.r.events, fmt.Sprintf("attempt %d %s", a.attempt, outcome))
+}
+
+// fakeBreaker allows the given number of hedged requests.
+type fakeBreaker struct {
+	mu        sync.Mutex
+	allowed   int
+	successes int
+	failures  int
+}
+
+func (b *fakeBreaker) AllowHedge() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.allowed--
+	return b.allowed >= 0
+}
+
+func (b *fakeBreaker) RecordResult(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.successes++
+	} else {
+		b.failures++
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closed int64
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt64(&c.closed, 1)
+	return nil
+}
+
 func shortestFrom(ts []time.Duration) time.Duration {
 	min := ts[0]
 	for _, t := range ts[1:] {
@@ -268,3 +6400,68 @@ func shortestFrom(ts []time.Duration) time.Duration {
 	}
 	return min
 }
+
+func BenchmarkDo(b *testing.B) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	for _, upto := range []int{1, 3} {
+		b.Run(fmt.Sprintf("upto=%d", upto), func(b *testing.B) {
+			client, err := NewClientWithOptions(&http.Client{Transport: rt},
+				WithTimeout(time.Second),
+				WithUpto(upto),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			req, err := http.NewRequest("GET", "http://example.com", http.NoBody)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Do(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkRoundTripUpto1(b *testing.B) {
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	hedged, err := NewRoundTripper(time.Second, 1, base)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "http://example.com", http.NoBody)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		rt   http.RoundTripper
+	}{
+		{"bare", base},
+		{"hedged", hedged},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp, err := bc.rt.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
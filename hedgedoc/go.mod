@@ -0,0 +1,8 @@
+module github.com/cristalhq/hedgedhttp/hedgedoc
+
+go 1.20
+
+require (
+	github.com/cristalhq/hedgedhttp v0.10.0
+	go.opencensus.io v0.24.0
+)
@@ -0,0 +1,122 @@
+// Package hedgedoc records hedgedhttp metrics with OpenCensus.
+//
+// Views mirror the metrics of github.com/cristalhq/hedgedhttp/hedgedprom:
+//
+//	if err := hedgedoc.RegisterOpenCensusViews(); err != nil {
+//		return err
+//	}
+//
+//	client, err := hedgedhttp.NewClientWithOptions(nil,
+//		hedgedhttp.WithTimeout(10*time.Millisecond),
+//		hedgedhttp.WithUpto(3),
+//		hedgedoc.WithRecorder(),
+//	)
+package hedgedoc
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Measures recorded by WithRecorder, every measurement is recorded with the request context.
+var (
+	MeasureRequests = stats.Int64("hedgedhttp/requests",
+		"Number of requested round trips.", stats.UnitDimensionless)
+	MeasureActualRoundTrips = stats.Int64("hedgedhttp/actual_roundtrips",
+		"Number of actual round trips including hedged requests.", stats.UnitDimensionless)
+	MeasureCanceledSubRequests = stats.Int64("hedgedhttp/canceled_subrequests",
+		"Number of canceled hedged requests.", stats.UnitDimensionless)
+	MeasureAttemptsPerRequest = stats.Int64("hedgedhttp/attempts_per_request",
+		"Number of requests sent per round trip.", stats.UnitDimensionless)
+)
+
+// ClientKey is the tag with the name of the client set with hedgedhttp.WithName,
+// it's added to the request context of named clients and used by all views.
+var ClientKey = tag.MustNewKey("client")
+
+// Views of the measures, named like the metrics of hedgedprom.
+var (
+	RequestsView = &view.View{
+		Name:        "hedgedhttp_requests_total",
+		Description: "Total number of requested round trips.",
+		Measure:     MeasureRequests,
+		TagKeys:     []tag.Key{ClientKey},
+		Aggregation: view.Count(),
+	}
+	ActualRoundTripsView = &view.View{
+		Name:        "hedgedhttp_actual_roundtrips_total",
+		Description: "Total number of actual round trips including hedged requests.",
+		Measure:     MeasureActualRoundTrips,
+		TagKeys:     []tag.Key{ClientKey},
+		Aggregation: view.Count(),
+	}
+	CanceledSubRequestsView = &view.View{
+		Name:        "hedgedhttp_canceled_subrequests_total",
+		Description: "Total number of canceled hedged requests.",
+		Measure:     MeasureCanceledSubRequests,
+		TagKeys:     []tag.Key{ClientKey},
+		Aggregation: view.Count(),
+	}
+	AttemptsPerRequestView = &view.View{
+		Name:        "hedgedhttp_attempts_per_request",
+		Description: "Number of requests sent per round trip.",
+		Measure:     MeasureAttemptsPerRequest,
+		TagKeys:     []tag.Key{ClientKey},
+		Aggregation: view.Distribution(1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
+	}
+)
+
+// Views are all views of hedgedhttp measures.
+var Views = []*view.View{RequestsView, ActualRoundTripsView, CanceledSubRequestsView, AttemptsPerRequestView}
+
+// RegisterOpenCensusViews registers all views of hedgedhttp measures, see Views.
+func RegisterOpenCensusViews() error {
+	return view.Register(Views...)
+}
+
+// WithRecorder returns an option which records hedgedhttp measures for the client.
+func WithRecorder() hedgedhttp.Option {
+	return hedgedhttp.WithTracer(recorder{})
+}
+
+type recorder struct{}
+
+func (recorder) Start(ctx context.Context, req *http.Request) (context.Context, hedgedhttp.Span) {
+	if name := hedgedhttp.ClientName(ctx); name != "" {
+		ctx, _ = tag.New(ctx, tag.Upsert(ClientKey, name))
+	}
+	stats.Record(ctx, MeasureRequests.M(1))
+	return ctx, &recorderSpan{ctx: ctx}
+}
+
+// recorderSpan counts requests of a round trip, its methods are called from a single goroutine.
+type recorderSpan struct {
+	ctx      context.Context
+	attempts int64
+}
+
+func (s *recorderSpan) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, hedgedhttp.AttemptSpan) {
+	s.attempts++
+	stats.Record(s.ctx, MeasureActualRoundTrips.M(1))
+	return ctx, recorderAttemptSpan{ctx: s.ctx}
+}
+
+func (s *recorderSpan) End(winner int, err error) {
+	stats.Record(s.ctx, MeasureAttemptsPerRequest.M(s.attempts))
+}
+
+type recorderAttemptSpan struct {
+	ctx context.Context
+}
+
+func (s recorderAttemptSpan) End(outcome hedgedhttp.AttemptOutcome, resp *http.Response, err error) {
+	if outcome == hedgedhttp.AttemptCanceled {
+		stats.Record(s.ctx, MeasureCanceledSubRequests.M(1))
+	}
+}
@@ -0,0 +1,80 @@
+package hedgedoc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"go.opencensus.io/stats/view"
+)
+
+func TestRecorder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") != "0" {
+			<-r.Context().Done() // hedged requests are always canceled
+			return
+		}
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	if err := RegisterOpenCensusViews(); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(Views...)
+
+	client, err := hedgedhttp.NewClientWithOptions(nil,
+		hedgedhttp.WithTimeout(5*time.Millisecond),
+		hedgedhttp.WithUpto(3),
+		hedgedhttp.WithHedgeHeader("X-Attempt"),
+		WithRecorder(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 2
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	wantCount(t, RequestsView, requests)
+	wantCount(t, ActualRoundTripsView, 3*requests)
+	wantCount(t, CanceledSubRequestsView, 2*requests)
+
+	rows, err := view.RetrieveData(AttemptsPerRequestView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("want 1 row, got %v", len(rows))
+	}
+	dist := rows[0].Data.(*view.DistributionData)
+	if dist.Count != requests || dist.Mean != 3 {
+		t.Fatalf("want %v round trips with 3 attempts, got %v with mean %v", requests, dist.Count, dist.Mean)
+	}
+}
+
+// wantCount waits until the count of the view reaches want, canceled requests are recorded in background.
+func wantCount(t *testing.T, v *view.View, want int64) {
+	t.Helper()
+	var got int64
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) == 1 {
+			if got = rows[0].Data.(*view.CountData).Value; got == want {
+				return
+			}
+		}
+	}
+	t.Fatalf("%s: want %v, got %v", v.Name, want, got)
+}
@@ -0,0 +1,113 @@
+// Package hedgedotel traces hedged round trips with OpenTelemetry.
+package hedgedotel
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/cristalhq/hedgedhttp/hedgedotel"
+
+// Attribute keys set on spans.
+const (
+	AttemptIndexKey  = attribute.Key("hedge.attempt_index")
+	DelayMsKey       = attribute.Key("hedge.delay_ms")
+	OutcomeKey       = attribute.Key("hedge.outcome")
+	WinnerKey        = attribute.Key("hedge.winner")
+	WinnerAttemptKey = attribute.Key("hedge.winner_attempt")
+	StatusCodeKey    = attribute.Key("http.status_code")
+	ClientKey        = attribute.Key("hedge.client")
+)
+
+// WithTracerProvider returns an option which traces hedged round trips with the given provider.
+// If tp is nil, the global provider is used.
+func WithTracerProvider(tp trace.TracerProvider) hedgedhttp.Option {
+	return hedgedhttp.WithTracer(NewTracer(tp))
+}
+
+// NewTracer returns a tracer which creates "hedged.request" span for a round trip
+// and a child "hedged.attempt" span for each of its requests. The request span has
+// hedge.client attribute if the client is named with hedgedhttp.WithName.
+// If tp is nil, the global provider is used.
+func NewTracer(tp trace.TracerProvider) hedgedhttp.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &tracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+func (t *tracer) Start(ctx context.Context, req *http.Request) (context.Context, hedgedhttp.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.method", req.Method),
+		attribute.String("http.url", req.URL.String()),
+	}
+	if name := hedgedhttp.ClientName(ctx); name != "" {
+		attrs = append(attrs, ClientKey.String(name))
+	}
+	ctx, span := t.tracer.Start(ctx, "hedged.request",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx, &requestSpan{tracer: t.tracer, span: span}
+}
+
+type requestSpan struct {
+	tracer trace.Tracer
+	span   trace.Span
+}
+
+func (s *requestSpan) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, hedgedhttp.AttemptSpan) {
+	ctx, span := s.tracer.Start(ctx, "hedged.attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			AttemptIndexKey.Int(attempt),
+			DelayMsKey.Float64(float64(delay)/float64(time.Millisecond)),
+		),
+	)
+	return ctx, &attemptSpan{span: span}
+}
+
+func (s *requestSpan) End(winner int, err error) {
+	if winner >= 0 {
+		s.span.SetAttributes(WinnerAttemptKey.Int(winner))
+	}
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+type attemptSpan struct {
+	span trace.Span
+}
+
+func (s *attemptSpan) End(outcome hedgedhttp.AttemptOutcome, resp *http.Response, err error) {
+	s.span.SetAttributes(
+		OutcomeKey.String(outcome.String()),
+		WinnerKey.Bool(outcome == hedgedhttp.AttemptWon),
+	)
+	if resp != nil {
+		s.span.SetAttributes(StatusCodeKey.Int(resp.StatusCode))
+	}
+
+	switch outcome {
+	case hedgedhttp.AttemptCanceled:
+		s.span.SetStatus(codes.Error, "canceled")
+	case hedgedhttp.AttemptFailed:
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
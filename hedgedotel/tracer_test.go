@@ -0,0 +1,151 @@
+package hedgedotel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Attempt") != "0" {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	client, err := hedgedhttp.NewClientWithOptions(srv.Client(),
+		hedgedhttp.WithTimeout(10*time.Millisecond),
+		hedgedhttp.WithUpto(3),
+		hedgedhttp.WithRequestDecorator(func(req *http.Request, attempt int) *http.Request {
+			req.Header.Set("X-Attempt", string(rune('0'+attempt)))
+			return req
+		}),
+		WithTracerProvider(tp),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// canceled attempts are ended in background
+	deadline := time.Now().Add(time.Second)
+	for len(sr.Ended()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	spans := sr.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("want 4 spans, got %d", len(spans))
+	}
+
+	var request sdktrace.ReadOnlySpan
+	attempts := map[int64]sdktrace.ReadOnlySpan{}
+	for _, s := range spans {
+		switch s.Name() {
+		case "hedged.request":
+			request = s
+		case "hedged.attempt":
+			attempts[attr(s, AttemptIndexKey).AsInt64()] = s
+		default:
+			t.Fatalf("unexpected span %q", s.Name())
+		}
+	}
+	if request == nil || len(attempts) != 3 {
+		t.Fatalf("want request span and 3 attempt spans, got %v", spans)
+	}
+	if got := attr(request, WinnerAttemptKey).AsInt64(); got != 0 {
+		t.Fatalf("want winner attempt 0, got %d", got)
+	}
+
+	for idx, s := range attempts {
+		if s.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Fatalf("attempt %d is not a child of request span", idx)
+		}
+		if idx > 0 && attr(s, DelayMsKey).AsFloat64() <= 0 {
+			t.Fatalf("attempt %d has no delay", idx)
+		}
+	}
+
+	won := attempts[0]
+	if !attr(won, WinnerKey).AsBool() {
+		t.Fatal("first attempt must be marked as winner")
+	}
+	if got := attr(won, StatusCodeKey).AsInt64(); got != http.StatusAccepted {
+		t.Fatalf("want status %d, got %d", http.StatusAccepted, got)
+	}
+	for _, idx := range []int64{1, 2} {
+		s := attempts[idx]
+		if attr(s, WinnerKey).AsBool() {
+			t.Fatalf("attempt %d must not be marked as winner", idx)
+		}
+		if s.Status().Code != codes.Error || s.Status().Description != "canceled" {
+			t.Fatalf("attempt %d: want canceled status, got %v", idx, s.Status())
+		}
+	}
+}
+
+func TestTracerError(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	rt := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, context.DeadlineExceeded
+	})
+	client, err := hedgedhttp.NewClientWithOptions(&http.Client{Transport: rt},
+		hedgedhttp.WithTimeout(time.Millisecond),
+		hedgedhttp.WithUpto(2),
+		WithTracerProvider(tp),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Get("http://example.com"); err == nil {
+		t.Fatal("want error")
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("want 3 spans, got %d", len(spans))
+	}
+	for _, s := range spans {
+		if s.Status().Code != codes.Error {
+			t.Fatalf("span %q: want error status, got %v", s.Name(), s.Status())
+		}
+	}
+}
+
+func attr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return fn(r) }
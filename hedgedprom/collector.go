@@ -0,0 +1,128 @@
+// Package hedgedprom exposes hedgedhttp metrics to Prometheus.
+//
+// Example registration with the default registry:
+//
+//	stats := &hedgedhttp.Stats{}
+//	collector := hedgedprom.NewPrometheusCollector(stats)
+//	prometheus.MustRegister(collector)
+//
+//	client, err := hedgedhttp.NewClientWithOptions(nil,
+//		hedgedhttp.WithTimeout(10*time.Millisecond),
+//		hedgedhttp.WithUpto(3),
+//		hedgedhttp.WithStats(stats),
+//		collector.Option(),
+//	)
+//
+// Collectors of several clients can be registered in the same registry
+// if they are created with different WithClientName.
+package hedgedprom
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for hedgedhttp metrics.
+type Collector struct {
+	stats *hedgedhttp.Stats
+
+	requests *prometheus.Desc
+	actual   *prometheus.Desc
+	canceled *prometheus.Desc
+	attempts prometheus.Histogram
+}
+
+// CollectorOption configures a Collector.
+type CollectorOption func(*collectorConfig)
+
+type collectorConfig struct {
+	labels prometheus.Labels
+}
+
+// WithClientName adds client label with the given name to all metrics,
+// usually the same name as in hedgedhttp.WithName. Empty name adds no label.
+func WithClientName(name string) CollectorOption {
+	return func(c *collectorConfig) {
+		if name != "" {
+			c.labels = prometheus.Labels{"client": name}
+		}
+	}
+}
+
+// NewPrometheusCollector returns a collector which exposes counters of the given stats:
+// hedgedhttp_requests_total, hedgedhttp_actual_roundtrips_total and hedgedhttp_canceled_subrequests_total.
+//
+// Histogram hedgedhttp_attempts_per_request is updated only by clients configured with Collector.Option.
+func NewPrometheusCollector(stats *hedgedhttp.Stats, opts ...CollectorOption) *Collector {
+	var cfg collectorConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Collector{
+		stats: stats,
+		requests: prometheus.NewDesc("hedgedhttp_requests_total",
+			"Total number of requested round trips.", nil, cfg.labels),
+		actual: prometheus.NewDesc("hedgedhttp_actual_roundtrips_total",
+			"Total number of actual round trips including hedged requests.", nil, cfg.labels),
+		canceled: prometheus.NewDesc("hedgedhttp_canceled_subrequests_total",
+			"Total number of canceled hedged requests.", nil, cfg.labels),
+		attempts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "hedgedhttp_attempts_per_request",
+			Help:        "Number of requests sent per round trip.",
+			ConstLabels: cfg.labels,
+			Buckets:     prometheus.LinearBuckets(1, 1, 10),
+		}),
+	}
+}
+
+// Option returns an option which records attempts per request histogram for the client.
+func (c *Collector) Option() hedgedhttp.Option {
+	return hedgedhttp.WithTracer(attemptsTracer{histogram: c.attempts})
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.actual
+	ch <- c.canceled
+	c.attempts.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(c.stats.RequestedRoundTrips()))
+	ch <- prometheus.MustNewConstMetric(c.actual, prometheus.CounterValue, float64(c.stats.ActualRoundTrips()))
+	ch <- prometheus.MustNewConstMetric(c.canceled, prometheus.CounterValue, float64(c.stats.CanceledSubRequests()))
+	c.attempts.Collect(ch)
+}
+
+type attemptsTracer struct {
+	histogram prometheus.Histogram
+}
+
+func (t attemptsTracer) Start(ctx context.Context, req *http.Request) (context.Context, hedgedhttp.Span) {
+	return ctx, &attemptsSpan{histogram: t.histogram}
+}
+
+// attemptsSpan counts requests of a round trip, its methods are called from a single goroutine.
+type attemptsSpan struct {
+	histogram prometheus.Histogram
+	attempts  int
+}
+
+func (s *attemptsSpan) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, hedgedhttp.AttemptSpan) {
+	s.attempts++
+	return ctx, noopAttemptSpan{}
+}
+
+func (s *attemptsSpan) End(winner int, err error) {
+	s.histogram.Observe(float64(s.attempts))
+}
+
+type noopAttemptSpan struct{}
+
+func (noopAttemptSpan) End(hedgedhttp.AttemptOutcome, *http.Response, error) {}
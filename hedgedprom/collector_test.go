@@ -0,0 +1,144 @@
+package hedgedprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/hedgedhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	stats := &hedgedhttp.Stats{}
+	collector := NewPrometheusCollector(stats)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	client, err := hedgedhttp.NewClientWithOptions(nil,
+		hedgedhttp.WithTimeout(5*time.Millisecond),
+		hedgedhttp.WithUpto(3),
+		hedgedhttp.WithStats(stats),
+		collector.Option(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 2
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := `
+# HELP hedgedhttp_actual_roundtrips_total Total number of actual round trips including hedged requests.
+# TYPE hedgedhttp_actual_roundtrips_total counter
+hedgedhttp_actual_roundtrips_total 6
+# HELP hedgedhttp_attempts_per_request Number of requests sent per round trip.
+# TYPE hedgedhttp_attempts_per_request histogram
+hedgedhttp_attempts_per_request_bucket{le="1"} 0
+hedgedhttp_attempts_per_request_bucket{le="2"} 0
+hedgedhttp_attempts_per_request_bucket{le="3"} 2
+hedgedhttp_attempts_per_request_bucket{le="4"} 2
+hedgedhttp_attempts_per_request_bucket{le="5"} 2
+hedgedhttp_attempts_per_request_bucket{le="6"} 2
+hedgedhttp_attempts_per_request_bucket{le="7"} 2
+hedgedhttp_attempts_per_request_bucket{le="8"} 2
+hedgedhttp_attempts_per_request_bucket{le="9"} 2
+hedgedhttp_attempts_per_request_bucket{le="10"} 2
+hedgedhttp_attempts_per_request_bucket{le="+Inf"} 2
+hedgedhttp_attempts_per_request_sum 6
+hedgedhttp_attempts_per_request_count 2
+# HELP hedgedhttp_requests_total Total number of requested round trips.
+# TYPE hedgedhttp_requests_total counter
+hedgedhttp_requests_total 2
+`
+	err = testutil.GatherAndCompare(registry, strings.NewReader(want),
+		"hedgedhttp_requests_total", "hedgedhttp_actual_roundtrips_total", "hedgedhttp_attempts_per_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectorNamedClients(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	registry := prometheus.NewPedanticRegistry()
+	for name, requests := range map[string]int{"users": 1, "orders": 2} {
+		stats := &hedgedhttp.Stats{}
+		collector := NewPrometheusCollector(stats, WithClientName(name))
+		registry.MustRegister(collector)
+
+		client, err := hedgedhttp.NewClientWithOptions(nil,
+			hedgedhttp.WithName(name),
+			hedgedhttp.WithTimeout(time.Second),
+			hedgedhttp.WithUpto(2),
+			hedgedhttp.WithStats(stats),
+			collector.Option(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < requests; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	want := `
+# HELP hedgedhttp_requests_total Total number of requested round trips.
+# TYPE hedgedhttp_requests_total counter
+hedgedhttp_requests_total{client="orders"} 2
+hedgedhttp_requests_total{client="users"} 1
+# HELP hedgedhttp_attempts_per_request Number of requests sent per round trip.
+# TYPE hedgedhttp_attempts_per_request histogram
+hedgedhttp_attempts_per_request_bucket{client="orders",le="1"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="2"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="3"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="4"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="5"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="6"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="7"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="8"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="9"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="10"} 2
+hedgedhttp_attempts_per_request_bucket{client="orders",le="+Inf"} 2
+hedgedhttp_attempts_per_request_sum{client="orders"} 2
+hedgedhttp_attempts_per_request_count{client="orders"} 2
+hedgedhttp_attempts_per_request_bucket{client="users",le="1"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="2"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="3"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="4"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="5"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="6"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="7"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="8"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="9"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="10"} 1
+hedgedhttp_attempts_per_request_bucket{client="users",le="+Inf"} 1
+hedgedhttp_attempts_per_request_sum{client="users"} 1
+hedgedhttp_attempts_per_request_count{client="users"} 1
+`
+	err := testutil.GatherAndCompare(registry, strings.NewReader(want),
+		"hedgedhttp_requests_total", "hedgedhttp_attempts_per_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package hedgedhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonLogBuffer is the number of lines waiting to be written, newer lines are dropped if it's full.
+const jsonLogBuffer = 1024
+
+// jsonLogger writes lines in a single background goroutine,
+// which is started on demand and exits when there is nothing to write.
+type jsonLogger struct {
+	w       io.Writer
+	lines   chan *[]byte
+	running int32
+	pool    sync.Pool
+}
+
+func newJSONLogger(w io.Writer) *jsonLogger {
+	l := &jsonLogger{
+		w:     w,
+		lines: make(chan *[]byte, jsonLogBuffer),
+	}
+	l.pool.New = func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	}
+	return l
+}
+
+// write doesn't block, the line is dropped if the buffer is full.
+func (l *jsonLogger) write(line *[]byte) {
+	select {
+	case l.lines <- line:
+	default:
+		l.pool.Put(line)
+	}
+	if atomic.CompareAndSwapInt32(&l.running, 0, 1) {
+		go l.flush()
+	}
+}
+
+func (l *jsonLogger) flush() {
+	for {
+		select {
+		case line := <-l.lines:
+			l.w.Write(*line)
+			l.pool.Put(line)
+		default:
+			atomic.StoreInt32(&l.running, 0)
+			// a line might be sent after the channel was found empty but before the flag was cleared.
+			if len(l.lines) == 0 || !atomic.CompareAndSwapInt32(&l.running, 0, 1) {
+				return
+			}
+		}
+	}
+}
+
+func (l *jsonLogger) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	id, ok := groupID(ctx)
+	if !ok {
+		id = newGroupID()
+	}
+	return ctx, &jsonSpan{
+		l:       l,
+		client:  ClientName(ctx),
+		groupID: id,
+		start:   time.Now(),
+	}
+}
+
+// jsonSpan collects a round trip, its methods are called from a single goroutine.
+// Canceled requests end after the round trip and are ignored.
+type jsonSpan struct {
+	l       *jsonLogger
+	client  string
+	groupID string
+	start   time.Time
+	delays  []time.Duration
+	errs    []error
+	status  int
+}
+
+func (s *jsonSpan) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, AttemptSpan) {
+	s.delays = append(s.delays, delay)
+	return ctx, jsonAttemptSpan{s: s}
+}
+
+func (s *jsonSpan) End(winner int, err error) {
+	if err != nil && len(s.errs) == 0 {
+		s.errs = append(s.errs, err)
+	}
+
+	line := s.l.pool.Get().(*[]byte)
+	*line = s.appendTo((*line)[:0], winner, time.Since(s.start))
+	s.l.write(line)
+}
+
+// appendTo appends the JSON object of the round trip followed by a newline.
+func (s *jsonSpan) appendTo(b []byte, winner int, latency time.Duration) []byte {
+	b = append(b, '{')
+	if s.client != "" {
+		b = append(b, `"client":`...)
+		b = appendJSONString(b, s.client)
+		b = append(b, ',')
+	}
+	b = append(b, `"group_id":`...)
+	b = appendJSONString(b, s.groupID)
+	b = append(b, `,"attempts":`...)
+	b = strconv.AppendInt(b, int64(len(s.delays)), 10)
+	b = append(b, `,"delays":[`...)
+	for i, d := range s.delays {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(d), 10)
+	}
+	b = append(b, `],"winner_attempt":`...)
+	b = strconv.AppendInt(b, int64(winner), 10)
+	b = append(b, `,"winner_status":`...)
+	b = strconv.AppendInt(b, int64(s.status), 10)
+	b = append(b, `,"total_latency":`...)
+	b = strconv.AppendInt(b, int64(latency), 10)
+	b = append(b, `,"errors":[`...)
+	for i, err := range s.errs {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, err.Error())
+	}
+	return append(b, "]}\n"...)
+}
+
+type jsonAttemptSpan struct {
+	s *jsonSpan
+}
+
+func (a jsonAttemptSpan) End(outcome AttemptOutcome, resp *http.Response, err error) {
+	switch outcome {
+	case AttemptWon:
+		a.s.status = resp.StatusCode
+	case AttemptFailed:
+		a.s.errs = append(a.s.errs, err)
+	}
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string, invalid UTF-8 is replaced by U+FFFD.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, "\ufffd"...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
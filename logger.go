@@ -0,0 +1,51 @@
+package hedgedhttp
+
+import (
+	"log"
+	"net/http"
+)
+
+// Logger logs lifecycle events of hedged requests.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// NewStdLogger returns a Logger which writes to the given standard logger.
+// If l is nil, the standard logger of the log package is used.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Logf(format string, args ...interface{}) {
+	s.l.Printf(format, args...)
+}
+
+// namedLogger prefixes messages with the client name, see WithName.
+type namedLogger struct {
+	l      Logger
+	prefix string
+}
+
+func (n namedLogger) Logf(format string, args ...interface{}) {
+	n.l.Logf(n.prefix+format, args...) // the name is validated, it has no verbs
+}
+
+func logAttempt(logger Logger, idx int, outcome AttemptOutcome, resp *http.Response, err error) {
+	switch {
+	case outcome == AttemptFailed:
+		logger.Logf("hedgedhttp: attempt %d failed: %v", idx, err)
+	case outcome == AttemptCanceled:
+		logger.Logf("hedgedhttp: attempt %d canceled", idx)
+	case resp != nil:
+		logger.Logf("hedgedhttp: attempt %d %s with status %d", idx, outcome, resp.StatusCode)
+	default:
+		logger.Logf("hedgedhttp: attempt %d %s", idx, outcome)
+	}
+}
@@ -0,0 +1,22 @@
+package hedgedhttp
+
+import "net/http"
+
+// Middleware wraps a RoundTripper with additional behaviour.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// NewMiddleware returns a Middleware which applies hedging to the next RoundTripper,
+// so hedging can be composed with other RoundTripper middlewares (auth, retries, logging, etc).
+// Hedged requests are sent to the next RoundTripper, nil next means http.DefaultTransport.
+//
+// Every call of the returned Middleware creates a new hedged RoundTripper,
+// all of them share the same options (including Stats if WithStats is used).
+func NewMiddleware(opts ...Option) (Middleware, error) {
+	cfg, err := newConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return newHedgedTransport(cfg, next)
+	}, nil
+}
@@ -0,0 +1,1061 @@
+package hedgedhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Option configures hedged client or round tripper.
+type Option func(*config)
+
+type config struct {
+	timeout   time.Duration
+	upto      int
+	delayFunc func(attempt int) time.Duration
+	stats     *Stats
+	name      string
+	named     bool
+	regret    *Stats
+
+	expBase   time.Duration
+	expFactor float64
+
+	firstHedgeDelay time.Duration
+
+	decorrelatedBase time.Duration
+	decorrelatedCap  time.Duration
+
+	jitter     float64
+	jitterSeed int64
+	seedSet    bool
+	randSource rand.Source
+
+	maxBufferedBody  int64
+	maxHedgeableLen  int64
+	hedgeableLenSet  bool
+	validator        func(*http.Response) ValidationResult
+	triggerOnInvalid bool
+	classifier       func(error) bool
+	errorAggregation ErrorAggregation
+	policy           SelectionPolicy
+	successStatuses  []int
+	selector         func(candidates []*http.Response) int
+	selectorMode     SelectorMode
+	maxConcurrency   int
+	hedgeableMethods []string
+	immediateFanout  bool
+	hedgeAfterWrite  bool
+	progressDetector bool
+	hedgeOnHeaders   bool
+	separateConns    bool
+	dialerForAttempt func(attempt int) func(ctx context.Context, network, addr string) (net.Conn, error)
+	proxyForAttempt  func(attempt int) func(*http.Request) (*url.URL, error)
+	clientForAttempt func(attempt int) *http.Client
+	decorator        func(req *http.Request, attempt int) *http.Request
+	contextTagger    func(ctx context.Context, attempt int) context.Context
+	hedgeHeader      string
+	groupHeader      string
+	hosts            []string
+	weightedHosts    []weightedHost
+	totalWeight      int
+	targetURLs       []*url.URL
+	redirects        bool // see WithRedirectPropagation
+	backupHost       string
+	backupDelay      time.Duration
+	backupTimeout    time.Duration
+
+	minRemainingBudget time.Duration
+	respectRetryAfter  bool
+	stopHeader         string
+	stopValue          string
+	breaker            CircuitBreaker
+	rateLimiter        RateLimiter
+	perAttemptTimeout  time.Duration
+	totalBudget        time.Duration
+	latencyBudget      time.Duration
+	drainLimit         int64
+	maxDrains          int
+	drainTimeout       time.Duration
+	loserGrace         time.Duration
+
+	adaptivePercentile float64
+	adaptiveSeed       time.Duration
+	adaptiveWindow     int
+
+	clock             Clock
+	onHedge           func(req *http.Request, attempt int)
+	onAttemptComplete func(attempt int, latency time.Duration, resp *http.Response, err error)
+	onAttemptCancel   func(attempt int)
+	dryRun            func(plan HedgePlan)
+	tracer            Tracer
+	logger            Logger
+
+	quorum          int
+	equal           func(a, b *http.Response) bool
+	quorumBodyLimit int64
+
+	// delayOpts keeps names of the options which set hedge delay, to detect conflicts.
+	delayOpts []string
+}
+
+// WithTimeout sets a fixed delay between consecutive hedged requests.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.timeout = timeout
+		c.addDelayOpt("WithTimeout")
+	}
+}
+
+// WithUpto sets the maximum number of requests started for a single round trip.
+func WithUpto(upto int) Option {
+	return func(c *config) {
+		c.upto = upto
+	}
+}
+
+// WithDelayFunc sets a function which returns a delay before the given attempt.
+// Attempt is a zero-based index, first attempt is always sent immediately,
+// so fn is called for attempts 1..upto-1 from the goroutine which schedules attempts.
+// Zero duration means the attempt is fired immediately, negative is treated as zero.
+// Cannot be used together with other delay options.
+func WithDelayFunc(fn func(attempt int) time.Duration) Option {
+	return func(c *config) {
+		c.delayFunc = fn
+		c.addDelayOpt("WithDelayFunc")
+	}
+}
+
+// WithExponentialDelay sets exponentially growing delay between hedged requests.
+// Attempt N (N >= 1) is started after base * factor^(N-1) from the previous one.
+// First request is always sent immediately. Cannot be used together with other delay options.
+func WithExponentialDelay(base time.Duration, factor float64) Option {
+	return func(c *config) {
+		c.expBase = base
+		c.expFactor = factor
+		c.addDelayOpt("WithExponentialDelay")
+	}
+}
+
+// WithDecorrelatedJitter sets decorrelated jitter delay between hedged requests:
+// delay = min(maxDelay, rand(base, prev*3)), where prev is the previous delay of the same round trip
+// and base for the first hedged request. Delays are always in [base, maxDelay] and use the random
+// source of the transport (see WithRandSource). Cannot be used together with other delay options.
+func WithDecorrelatedJitter(base, maxDelay time.Duration) Option {
+	return func(c *config) {
+		c.decorrelatedBase = base
+		c.decorrelatedCap = maxDelay
+		c.addDelayOpt("WithDecorrelatedJitter")
+	}
+}
+
+// WithFirstHedgeDelay sets a delay before the first hedged request (attempt 1),
+// next requests use the normal schedule. It gives the first request extra time,
+// e.g. to establish a cold connection, before escalating.
+// The delay takes precedence over WithTimeout, WithDelayFunc, WithExponentialDelay and WithAdaptiveDelay,
+// but not over WithRequestTimeout. Zero means attempt 1 uses the normal schedule.
+func WithFirstHedgeDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.firstHedgeDelay = d
+	}
+}
+
+// WithJitter randomizes each hedge delay uniformly within ±fraction of the nominal delay.
+// Fraction must be in [0, 1]. Jittered delay is never negative.
+func WithJitter(fraction float64) Option {
+	return func(c *config) {
+		c.jitter = fraction
+	}
+}
+
+// WithJitterSeed sets a seed for the random source of jitter and weighted hosts, useful for reproducible tests.
+// By default the source is seeded from crypto/rand.
+func WithJitterSeed(seed int64) Option {
+	return func(c *config) {
+		c.jitterSeed = seed
+		c.seedSet = true
+	}
+}
+
+// WithRandSource sets the source of all randomized decisions: jitter and weighted hosts.
+// The transport guards the source with a mutex, so it must not be used elsewhere.
+// Takes precedence over WithJitterSeed.
+func WithRandSource(source rand.Source) Option {
+	return func(c *config) {
+		c.randSource = source
+	}
+}
+
+// WithMaxBufferedBody sets the maximum size of a request body which is buffered in memory
+// to be replayed for hedged requests. Requests with a larger body and without GetBody
+// are sent only once. Default is 1 MiB.
+// Every attempt gets the same bytes, including multipart boundaries, and declared trailers
+// (see http.Request.Trailer): such body keeps its unknown length, so it's sent chunked with trailers.
+func WithMaxBufferedBody(n int64) Option {
+	return func(c *config) {
+		c.maxBufferedBody = n
+	}
+}
+
+// WithMaxHedgeableContentLength sends requests with a body larger than n bytes only once,
+// so large uploads are not duplicated. Body of unknown length (e.g. streaming) is treated
+// as larger than n, unless it's buffered (see WithMaxBufferedBody) and its size is checked then,
+// a buffered body with trailers still counts as unknown.
+func WithMaxHedgeableContentLength(n int64) Option {
+	return func(c *config) {
+		c.maxHedgeableLen = n
+		c.hedgeableLenSet = true
+	}
+}
+
+// WithResponseValidator sets a function which decides whether a response is good enough to be returned.
+// Rejected response is discarded and the transport waits for other requests,
+// the last rejected response is returned only if all requests are finished without a valid response.
+// A response is accepted if fn panics.
+func WithResponseValidator(fn func(*http.Response) bool) Option {
+	return func(c *config) {
+		c.validator = nil
+		if fn != nil {
+			c.validator = func(resp *http.Response) ValidationResult {
+				if fn(resp) {
+					return Accept
+				}
+				return RejectRetry
+			}
+		}
+	}
+}
+
+// ValidationResult is a decision of the response validator, see WithResponseValidation.
+type ValidationResult int
+
+const (
+	// Accept accepts the response, it's returned if it satisfies the selection policy.
+	Accept ValidationResult = iota
+
+	// RejectRetry rejects the response, the transport waits for other requests, like a rejection
+	// of WithResponseValidator. Unknown results are treated as RejectRetry.
+	RejectRetry
+
+	// RejectStop rejects the response as final, e.g. 401 which won't change on another request:
+	// the response is returned immediately and other requests are canceled.
+	RejectStop
+)
+
+// WithResponseValidation is like WithResponseValidator, but fn can also stop the round trip
+// with a rejected response, see ValidationResult. Options override each other.
+func WithResponseValidation(fn func(*http.Response) ValidationResult) Option {
+	return func(c *config) {
+		c.validator = fn
+	}
+}
+
+// WithValidationTriggeredHedging starts the next request immediately when a response
+// is rejected by the validator (see WithResponseValidator and WithResponseValidation), which is required.
+// If no delay option is set, requests are not started on a timer at all, only on rejected
+// responses and errors. Otherwise both the timer and rejected responses start requests.
+func WithValidationTriggeredHedging(enabled bool) Option {
+	return func(c *config) {
+		c.triggerOnInvalid = enabled
+	}
+}
+
+// WithErrorClassifier sets a function which reports whether a request error is retryable.
+// Non-retryable error aborts all requests immediately and is returned as is.
+// The error is retryable if fn panics.
+func WithErrorClassifier(fn func(error) bool) Option {
+	return func(c *config) {
+		c.classifier = fn
+	}
+}
+
+// WithErrorAggregation sets which error is returned when all requests have failed,
+// default is AggregateAll.
+func WithErrorAggregation(mode ErrorAggregation) Option {
+	return func(c *config) {
+		c.errorAggregation = mode
+	}
+}
+
+// SelectionPolicy defines which response is returned from hedged requests.
+type SelectionPolicy int
+
+const (
+	// PolicyFirstDone returns the first completed response. This is the default.
+	PolicyFirstDone SelectionPolicy = iota
+
+	// PolicyBestStatus returns the first 2xx response, otherwise waits for all requests
+	// and returns the response with the best status class: 2xx, 3xx, 4xx, 5xx.
+	// Among responses of the same class which are available at the same time
+	// the response of the lowest attempt is returned.
+	PolicyBestStatus
+
+	// PolicyFirstSuccess returns the first response with a success status, 2xx by default
+	// (see WithSuccessStatuses). Other responses are discarded and the transport waits for
+	// other requests, the last response is returned only if none of them has succeeded.
+	PolicyFirstSuccess
+
+	// PolicyWaitAll waits for all requests (up to upto, started with the usual delays)
+	// and then calls the response selector, see WithResponseSelector. Without a selector
+	// the response of the lowest attempt is returned, a response rejected by WithResponseValidator
+	// only if all responses are rejected. Latency of the round trip is the latency
+	// of the slowest request, context cancellation still ends the round trip immediately.
+	PolicyWaitAll
+)
+
+// WithSelectionPolicy sets the policy which selects a response to return.
+func WithSelectionPolicy(policy SelectionPolicy) Option {
+	return func(c *config) {
+		c.policy = policy
+	}
+}
+
+// WithMaxConcurrency limits how many requests of a single round trip are in flight at once.
+// When the limit is reached the next request waits until one of the previous requests
+// has finished, upto still limits the total number of requests. Zero means no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(c *config) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithImmediateFanout starts all requests at once without any delay, delay options are ignored.
+// Combined with WithMaxConcurrency only n requests are in flight, the next one is started
+// as soon as one of them has finished without a response that can be returned.
+func WithImmediateFanout(enabled bool) Option {
+	return func(c *config) {
+		c.immediateFanout = enabled
+	}
+}
+
+// WithHedgeAfterWriteRequest starts the delay before the next request only when the previous request
+// is written (see httptrace.ClientTrace.WroteRequest) or has finished, so no duplicate is sent
+// while the previous request is still stuck in connection setup. The delay passed to the tracer
+// and the logger doesn't include the time waited for the write. The underlying transport must
+// report WroteRequest, like *http.Transport does, otherwise hedged requests are started only
+// when previous requests have finished.
+func WithHedgeAfterWriteRequest(enabled bool) Option {
+	return func(c *config) {
+		c.hedgeAfterWrite = enabled
+	}
+}
+
+// WithProgressDetector stops starting hedged requests once the first request has received
+// the first byte of a response (see httptrace.ClientTrace.GotFirstResponseByte), including
+// informational responses like 100 Continue or 103 Early Hints: the backend is slow but working,
+// so more requests would only add load. Requests which are already started are not canceled.
+// If the first request fails or its response is rejected, starting hedged requests is resumed.
+// The underlying transport must report GotFirstResponseByte, like *http.Transport does.
+func WithProgressDetector(enabled bool) Option {
+	return func(c *config) {
+		c.progressDetector = enabled
+	}
+}
+
+// WithHedgeOnHeaderTimeout makes the hedge delay a timeout of response headers: while any request
+// has received the first byte of a response (see httptrace.ClientTrace.GotFirstResponseByte)
+// and has no result yet, no more hedged requests are started. Unlike WithProgressDetector,
+// which watches only the first request, any request counts, including informational responses
+// like 103 Early Hints. If such a request fails or its response is rejected (see
+// WithResponseValidator and PolicyFirstSuccess), starting hedged requests is resumed.
+// The underlying transport must report GotFirstResponseByte, like *http.Transport does.
+func WithHedgeOnHeaderTimeout(enabled bool) Option {
+	return func(c *config) {
+		c.hedgeOnHeaders = enabled
+	}
+}
+
+// WithSeparateConnections makes every hedged request use its own connection pool.
+// With HTTP/2 all requests to a host are multiplexed over a single connection,
+// so hedging doesn't help against a slow connection.
+//
+// Works only if the underlying transport is an *http.Transport (http.DefaultTransport by default),
+// it is cloned for every request up to upto, requests above that (see WithRequestUpto) reuse the clones.
+// Otherwise the option has no effect.
+func WithSeparateConnections(enabled bool) Option {
+	return func(c *config) {
+		c.separateConns = enabled
+	}
+}
+
+// WithDialerForAttempt sets a function which returns the dial function for the given request,
+// e.g. to dial from another local address or network interface of a multi-homed host,
+// so hedged requests take different network paths. Attempt is a zero-based index.
+// Returning nil means the dialer of the underlying transport is used.
+//
+// Connections are pooled by the transport regardless of the dialer, so every request with
+// its own dialer needs its own transport: like WithSeparateConnections it works only if
+// the underlying transport is an *http.Transport, which is cloned once for every request up to upto
+// with DialContext replaced, requests above that reuse the clones. Otherwise the option has no effect.
+// The dialer is not used for TLS connections if the transport has DialTLSContext set.
+func WithDialerForAttempt(fn func(attempt int) func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *config) {
+		c.dialerForAttempt = fn
+	}
+}
+
+// WithProxyForAttempt sets a function which returns the proxy function for the given request,
+// e.g. to send some requests through a proxy for geo-diversity and others directly.
+// Attempt is a zero-based index. Returning nil means the proxy of the underlying transport is used,
+// a proxy function returning nil URL sends the request directly, see http.Transport.Proxy.
+//
+// Like WithDialerForAttempt it works only if the underlying transport is an *http.Transport,
+// which is cloned once for every request up to upto with Proxy replaced, so connection pools
+// are kept between round trips. Both options can be used together.
+func WithProxyForAttempt(fn func(attempt int) func(*http.Request) (*url.URL, error)) Option {
+	return func(c *config) {
+		c.proxyForAttempt = fn
+	}
+}
+
+// WithClientForAttempt sets a function which returns the client to send the given request with,
+// e.g. to send hedged requests through a proxy in another region. Attempt is a zero-based index.
+// Only the Transport of the returned client is used (http.DefaultTransport if it's nil),
+// other fields like Timeout, Jar or CheckRedirect are ignored. Returning nil means
+// the request is sent with the underlying transport of the hedged client.
+// Takes precedence over WithSeparateConnections, WithDialerForAttempt and WithProxyForAttempt.
+func WithClientForAttempt(fn func(attempt int) *http.Client) Option {
+	return func(c *config) {
+		c.clientForAttempt = fn
+	}
+}
+
+// WithRedirectPropagation returns a redirect (301, 302, 303, 307 or 308 with Location header)
+// as soon as any request gets it, regardless of the selection policy, and cancels other requests,
+// which would still do the work at the original URL. A rejection by the validator takes precedence.
+//
+// Redirects are followed by http.Client above the transport: every hop is a separate hedged
+// round trip, so all requests go to the new URL and the response returned by the client has
+// Request.URL of the final request. CheckRedirect of the client is applied as usual, e.g. with
+// http.ErrUseLastResponse the redirect itself is returned. If the underlying transport follows
+// redirects itself, the request of its response is kept as is.
+func WithRedirectPropagation(enabled bool) Option {
+	return func(c *config) {
+		c.redirects = enabled
+	}
+}
+
+// WithRespectRetryAfter stops starting new requests once a response with Retry-After header is received.
+// The response is returned if no better response arrives from requests which are already in flight.
+func WithRespectRetryAfter(enabled bool) Option {
+	return func(c *config) {
+		c.respectRetryAfter = enabled
+	}
+}
+
+// WithStopOnHeader stops starting new requests once a response with the given header is received,
+// e.g. X-Overloaded: 1. Header name is case-insensitive, empty value matches any value.
+// Like with WithRespectRetryAfter the response is returned if no better response arrives
+// from requests which are already in flight.
+func WithStopOnHeader(name, value string) Option {
+	return func(c *config) {
+		c.stopHeader = name
+		c.stopValue = value
+	}
+}
+
+// WithHedgeableMethods sets HTTP methods which can be hedged, requests with other methods
+// are sent exactly once regardless of upto. Default is idempotent methods:
+// GET, HEAD, OPTIONS, PUT and DELETE. Empty list disables hedging for all methods.
+func WithHedgeableMethods(methods []string) Option {
+	return func(c *config) {
+		c.hedgeableMethods = append([]string{}, methods...)
+	}
+}
+
+// WithRequestDecorator sets a function which is called for every request copy before it's sent.
+// Attempt is a zero-based index. The given request is a deep clone of the original request,
+// so it can be safely modified, e.g. headers set for one attempt are not seen by other attempts.
+// Returning nil means the clone is used unchanged, as well as a panic of fn.
+func WithRequestDecorator(fn func(req *http.Request, attempt int) *http.Request) Option {
+	return func(c *config) {
+		c.decorator = fn
+	}
+}
+
+// WithContextTagger sets a function which returns the context for the given request,
+// e.g. to add attempt-specific values for logging. Attempt is a zero-based index.
+// The returned context must be derived from ctx, so cancellation of the round trip is propagated.
+// Returning nil means ctx is used unchanged.
+func WithContextTagger(fn func(ctx context.Context, attempt int) context.Context) Option {
+	return func(c *config) {
+		c.contextTagger = fn
+	}
+}
+
+// WithHedgeHeader sets the header with the given name to the zero-based attempt index
+// on every request, so the backend can deprioritize or shed hedged requests.
+// Empty name (default) disables the header.
+func WithHedgeHeader(name string) Option {
+	return func(c *config) {
+		c.hedgeHeader = name
+	}
+}
+
+// WithHedgeGroupHeader sets the header with the given name to a random UUID on every request,
+// the value is the same for all requests of a round trip, so the backend can correlate them.
+// Empty name (default) disables the header.
+func WithHedgeGroupHeader(name string) Option {
+	return func(c *config) {
+		c.groupHeader = name
+	}
+}
+
+// WithHostRotation sends every request to the next host in round-robin order:
+// attempt i is sent to hosts[i % len(hosts)], both URL host and Host header are rewritten.
+// If hosts is empty, all requests are sent to the original host.
+//
+// A host whose request has failed with an error is not used again in the same round trip,
+// the request goes to the next host which hasn't failed. When all hosts have failed,
+// no more requests are sent and the errors are returned once requests in flight have finished.
+func WithHostRotation(hosts []string) Option {
+	return func(c *config) {
+		c.hosts = append([]string(nil), hosts...)
+	}
+}
+
+// WithWeightedHosts sends every hedged request (attempt >= 1) to a random host,
+// the probability of each host is proportional to its weight. The first request
+// is sent to the original host, use WithRequestDecorator to override it.
+// Selection uses the same random source as jitter, see WithRandSource for reproducible tests.
+// Cannot be used together with WithHostRotation and WithTargetURLs.
+func WithWeightedHosts(weights map[string]int) Option {
+	return func(c *config) {
+		c.weightedHosts = c.weightedHosts[:0]
+		c.totalWeight = 0
+		for host, weight := range weights {
+			c.weightedHosts = append(c.weightedHosts, weightedHost{host: host, weight: weight})
+			c.totalWeight += weight
+		}
+		// map order is random, sort hosts to make selection reproducible
+		sort.Slice(c.weightedHosts, func(i, j int) bool {
+			return c.weightedHosts[i].host < c.weightedHosts[j].host
+		})
+	}
+}
+
+// WithBackup configures a primary plus backup round trip: the request is sent to the original host,
+// if there is no answer in delay, exactly one backup request is sent to the given host.
+// The backup request is limited by perAttemptTimeout, the primary one by WithPerAttemptTimeout,
+// zero means no limit. Upto is ignored, at most 2 requests are sent.
+// Cannot be used together with other delay options, WithHostRotation, WithWeightedHosts and WithTargetURLs.
+func WithBackup(host string, delay, perAttemptTimeout time.Duration) Option {
+	return func(c *config) {
+		c.backupHost = host
+		c.backupDelay = delay
+		c.backupTimeout = perAttemptTimeout
+		c.addDelayOpt("WithBackup")
+	}
+}
+
+// WithTargetURLs sends every request to the next URL in round-robin order:
+// attempt i is sent to urls[i % len(urls)], the whole URL and Host header are rewritten,
+// method, headers and body are kept. If urls is empty, all requests are sent to the original URL.
+// All URLs must be absolute. Cannot be used together with WithHostRotation, WithWeightedHosts and WithBackup.
+func WithTargetURLs(urls []*url.URL) Option {
+	return func(c *config) {
+		c.targetURLs = append([]*url.URL(nil), urls...)
+	}
+}
+
+type weightedHost struct {
+	host   string
+	weight int
+}
+
+// WithMinRemainingBudget sets the minimum time before the request context deadline
+// required to start a hedged request. Zero means requests are started regardless of the deadline.
+func WithMinRemainingBudget(d time.Duration) Option {
+	return func(c *config) {
+		c.minRemainingBudget = d
+	}
+}
+
+// WithCircuitBreaker sets a circuit breaker which is consulted before every hedged request.
+// When it doesn't allow hedging, only the requests which are already started are used.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return func(c *config) {
+		c.breaker = cb
+	}
+}
+
+// WithRateLimiter sets a rate limiter which every request (including the first one) waits for
+// before it's sent. Waiting is interrupted when the request is canceled, e.g. because another
+// request has won, such requests are reported as canceled.
+func WithRateLimiter(rl RateLimiter) Option {
+	return func(c *config) {
+		c.rateLimiter = rl
+	}
+}
+
+// WithTotalBudget stops starting new requests once d has elapsed since the round trip started,
+// regardless of upto and delays between requests. Requests in flight are not canceled,
+// if none of them returns a response, the best available response or the aggregated error is returned.
+// Zero means no budget.
+func WithTotalBudget(d time.Duration) Option {
+	return func(c *config) {
+		c.totalBudget = d
+	}
+}
+
+// WithLatencyBudget sets a hard latency limit of the round trip (SLO): if no response which
+// ends the round trip has arrived within d since it started, all requests are canceled
+// and *LatencyBudgetError is returned, which matches ErrLatencyBudgetExceeded.
+// Unlike WithTotalBudget, the round trip is failed, and unlike the context deadline,
+// the error tells SLO breach apart from cancellation. Zero means no budget.
+func WithLatencyBudget(d time.Duration) Option {
+	return func(c *config) {
+		c.latencyBudget = d
+	}
+}
+
+// WithPerAttemptTimeout sets a timeout for every single request, it doesn't affect other requests.
+// Timed out request releases its concurrency slot and its error is reported like any other
+// request error. Zero means requests are limited only by the round trip context.
+func WithPerAttemptTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.perAttemptTimeout = d
+	}
+}
+
+// WithDrainLimit sets the maximum number of bytes read from a discarded response body
+// before it's closed. Draining the body allows to reuse the connection. Default is 64 KiB.
+// Bodies are drained in background, see WithMaxConcurrentDrains and WithDrainTimeout.
+func WithDrainLimit(n int64) Option {
+	return func(c *config) {
+		c.drainLimit = n
+	}
+}
+
+// WithMaxConcurrentDrains sets the maximum number of discarded response bodies drained at once
+// by a client, further bodies wait until one is drained. Default is 8.
+func WithMaxConcurrentDrains(n int) Option {
+	return func(c *config) {
+		c.maxDrains = n
+	}
+}
+
+// WithDrainTimeout sets how long a discarded response may wait for draining and be drained,
+// including the time in the queue (see WithMaxConcurrentDrains). Then its request is canceled,
+// so a body which never ends, like a long poll, doesn't hold the connection. Default is 1s.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.drainTimeout = d
+	}
+}
+
+// WithLoserGracePeriod lets requests in flight finish for at most d after the response is selected,
+// instead of canceling them at once. Their responses are discarded and drained (see WithDrainLimit),
+// so connections are reused and the backend doesn't see canceled requests, at the cost of finishing
+// the work which is not needed. Requests which don't finish in time, or when the request context
+// is done, are canceled. Zero (default) cancels requests in flight at once.
+// With WithRegretMetric the longer of both waits is used. The returned response
+// is not delayed, requests are awaited in background.
+func WithLoserGracePeriod(d time.Duration) Option {
+	return func(c *config) {
+		c.loserGrace = d
+	}
+}
+
+// WithAdaptiveDelay sets hedge delay to the given percentile (in (0, 100], e.g. 90 for p90)
+// of the latest first request latencies. Only first requests which returned a response are
+// taken into account. Until the window is full the seed delay is used (see WithAdaptiveSeed).
+// Current delay is reported by Stats.AdaptiveDelay. Cannot be used together with other delay options.
+func WithAdaptiveDelay(percentile float64) Option {
+	return func(c *config) {
+		c.adaptivePercentile = percentile
+		c.addDelayOpt("WithAdaptiveDelay")
+	}
+}
+
+// WithAdaptiveSeed sets the delay used by WithAdaptiveDelay until window latencies are collected,
+// and the size of the window. Default window size is 100.
+func WithAdaptiveSeed(delay time.Duration, window int) Option {
+	return func(c *config) {
+		c.adaptiveSeed = delay
+		c.adaptiveWindow = window
+	}
+}
+
+// WithClock sets the clock used to schedule hedged requests and to measure their latency,
+// default is the real clock. It's meant for deterministic tests.
+// Time left before the context deadline is measured with this clock too,
+// but the context itself still expires by the real time.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithOnHedge sets a callback which is called right before a hedged request (attempt >= 1) is sent.
+// The callback receives a request copy and is called even if the request is canceled later.
+// It's called on the goroutine of the request, it doesn't block scheduling of other requests,
+// but it delays the request itself, so it should be fast. A panic of fn doesn't stop the request.
+func WithOnHedge(fn func(req *http.Request, attempt int)) Option {
+	return func(c *config) {
+		c.onHedge = fn
+	}
+}
+
+// WithOnAttemptComplete sets a callback which is called when every request (including the first one)
+// has finished, with its latency and either response or error. Requests canceled by transport
+// get the context error. The callback is for metadata only: it must not read or close resp.Body,
+// the body still belongs to the transport or to the caller.
+// It's called on the goroutine of the request, so it must be safe for concurrent use and fast.
+// Connection details of the request are available with AttemptConnTrace(resp).
+func WithOnAttemptComplete(fn func(attempt int, latency time.Duration, resp *http.Response, err error)) Option {
+	return func(c *config) {
+		c.onAttemptComplete = fn
+	}
+}
+
+// WithOnAttemptCanceled sets a callback which is called exactly once for every sent request
+// which hasn't won: canceled because another response was returned, discarded, or failed,
+// so resources allocated for the request (e.g. in WithRequestDecorator) can be released.
+// It's never called for the returned response, whose resources belong to the caller.
+// Canceled requests are reported in background after the round trip has returned.
+func WithOnAttemptCanceled(fn func(attempt int)) Option {
+	return func(c *config) {
+		c.onAttemptCancel = fn
+	}
+}
+
+// WithDryRun enables dry-run mode: only the first request is sent and the given function
+// gets the plan of hedged requests which would be sent with the current configuration.
+// It helps to estimate the load amplification before enabling hedging.
+// The function is called on the goroutine of the round trip before it returns.
+func WithDryRun(fn func(plan HedgePlan)) Option {
+	return func(c *config) {
+		c.dryRun = fn
+	}
+}
+
+// WithTracer sets a tracer for hedged round trips and their requests.
+// Can be used multiple times, tracers are called in the order they are given.
+func WithTracer(tracer Tracer) Option {
+	return func(c *config) {
+		c.tracer = joinTracers(c.tracer, tracer)
+	}
+}
+
+// WithEventChannel sends lifecycle events of hedged requests to the given channel.
+// Events are sent without blocking and dropped if the channel is full, so a slow consumer
+// cannot stall requests. A buffer of at least a few events per request in flight,
+// e.g. 4 * upto * concurrent round trips, keeps drops rare.
+// Canceled requests report their events after the round trip has returned.
+func WithEventChannel(ch chan<- Event) Option {
+	return func(c *config) {
+		c.tracer = joinTracers(c.tracer, eventTracer{ch: ch})
+	}
+}
+
+// WithJSONLogger writes a JSON object per round trip to w, one per line:
+//
+//	{"group_id":"7f3c...","attempts":2,"delays":[0,10000000],"winner_attempt":1,
+//	 "winner_status":200,"total_latency":12500000,"errors":[]}
+//
+// Delays and total latency are in nanoseconds, winner_attempt is -1 and
+// winner_status is 0 if the round trip has failed. Errors are errors of failed requests,
+// or the round trip error if no request has failed. group_id is the value of the
+// WithHedgeGroupHeader header if it's set. The object starts with "client" field
+// if the client is named with WithName.
+//
+// Lines are written by a background goroutine and dropped if too many are waiting,
+// so a slow writer cannot stall requests.
+func WithJSONLogger(w io.Writer) Option {
+	return func(c *config) {
+		c.tracer = joinTracers(c.tracer, newJSONLogger(w))
+	}
+}
+
+// WithName sets the name of the client, so metrics, logs and spans of several clients
+// can be told apart: log messages are prefixed with it in square brackets, tracers and
+// other integrations can read it from the context (see ClientName).
+// The name must be non-empty and contain only ASCII letters, digits, '_' and '-'.
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name, c.named = name, true
+	}
+}
+
+// WithLogger sets a logger for lifecycle events of hedged requests:
+// start, completion, error, cancellation and the selected response.
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithQuorum returns a response only after n responses are equal according to the given predicate.
+// If attempts run out before the quorum is reached, the response agreed by the most responses is returned.
+// Only responses accepted by the validator and the selection policy take part in the quorum.
+//
+// Response bodies are buffered in memory for comparison, so a single round trip may hold
+// up to upto * limit bytes, see WithQuorumBodyLimit. The predicate gets responses with
+// rewound bodies and may read them, returned response body is rewound too.
+// DecodedBodyEqual can be used as the predicate to compare bodies regardless of compression.
+func WithQuorum(n int, equal func(a, b *http.Response) bool) Option {
+	return func(c *config) {
+		c.quorum = n
+		c.equal = equal
+	}
+}
+
+// WithQuorumBodyLimit sets the maximum size of a response body buffered for WithQuorum.
+// Larger responses don't take part in the quorum and are returned only if no response has voted.
+// Default is 1 MiB.
+func WithQuorumBodyLimit(n int64) Option {
+	return func(c *config) {
+		c.quorumBodyLimit = n
+	}
+}
+
+// WithStats sets the Stats object which collects client's metrics.
+// Same Stats can be shared by several clients to aggregate their metrics.
+func WithStats(stats *Stats) Option {
+	return func(c *config) {
+		c.stats = stats
+	}
+}
+
+// WithRegretMetric counts responses which would have been better to return in the given stats,
+// see Stats.Regret, e.g. to decide whether PolicyBestStatus is worth its latency.
+// If the returned response doesn't have a 2xx status, requests in flight are not canceled at once:
+// their responses are observed at most as long as the round trip has taken and within the remaining
+// total budget (see WithTotalBudget), a response with a better status class is counted.
+// The returned response is not delayed, observation happens in background.
+// The stats can be the same as of WithStats.
+func WithRegretMetric(stats *Stats) Option {
+	return func(c *config) {
+		c.regret = stats
+	}
+}
+
+const (
+	defaultMaxBufferedBody = 1 << 20
+	defaultDrainLimit      = 64 << 10
+	defaultMaxDrains       = 8
+	defaultDrainTimeout    = time.Second
+)
+
+func defaultConfig() *config {
+	return &config{
+		maxBufferedBody: defaultMaxBufferedBody,
+		drainLimit:      defaultDrainLimit,
+		maxDrains:       defaultMaxDrains,
+		drainTimeout:    defaultDrainTimeout,
+		quorumBodyLimit: defaultMaxBufferedBody,
+		hedgeableMethods: []string{
+			http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete,
+		},
+	}
+}
+
+func newConfig(opts ...Option) (*config, error) {
+	c := defaultConfig()
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.hasDelayOpt("WithBackup") {
+		c.upto = 2 // upto is ignored
+		c.timeout = c.backupDelay
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.hasDelayOpt("WithExponentialDelay") {
+		c.delayFunc = exponentialDelay(c.expBase, c.expFactor)
+	}
+	return c, nil
+}
+
+// WithResponseSelector sets a function which makes the final choice of the returned response.
+// It gets all completed responses in the order of arrival with bodies not read yet,
+// and returns the index of the response to keep, others are drained and closed.
+// When it's called is defined by WithSelectorMode. Selector takes precedence over WithQuorum.
+// An index out of range or a panic of fn selects the response of the lowest attempt,
+// a response rejected by WithResponseValidator or the selection policy only if all are rejected.
+func WithResponseSelector(fn func(candidates []*http.Response) int) Option {
+	return func(c *config) {
+		c.selector = fn
+	}
+}
+
+// WithSelectorMode sets when the response selector is called, default is SelectOnFirstReady.
+func WithSelectorMode(mode SelectorMode) Option {
+	return func(c *config) {
+		c.selectorMode = mode
+	}
+}
+
+// WithSuccessStatuses sets status codes which satisfy PolicyFirstSuccess instead of 2xx.
+func WithSuccessStatuses(codes []int) Option {
+	return func(c *config) {
+		c.successStatuses = append([]int(nil), codes...)
+	}
+}
+
+func (c *config) validate() error {
+	if c.upto < 1 {
+		return errors.New("hedgedhttp: upto must be >= 1")
+	}
+	// backup delay is the timeout, so it's checked first to report the right option
+	if c.hasDelayOpt("WithBackup") {
+		switch {
+		case c.backupHost == "":
+			return errors.New("hedgedhttp: backup host cannot be empty")
+		case c.backupDelay < 0 || c.backupTimeout < 0:
+			return errors.New("hedgedhttp: backup delay and per attempt timeout must be >= 0")
+		case len(c.hosts) > 0 || len(c.weightedHosts) > 0 || len(c.targetURLs) > 0:
+			return errors.New("hedgedhttp: option WithBackup cannot be used with WithHostRotation, WithWeightedHosts or WithTargetURLs")
+		}
+	}
+	if c.timeout < 0 {
+		return errors.New("hedgedhttp: timeout must be >= 0")
+	}
+	if len(c.delayOpts) > 1 {
+		return fmt.Errorf("hedgedhttp: options %s are mutually exclusive", strings.Join(c.delayOpts, ", "))
+	}
+	if c.hasDelayOpt("WithDecorrelatedJitter") && (c.decorrelatedBase <= 0 || c.decorrelatedCap < c.decorrelatedBase) {
+		return errors.New("hedgedhttp: decorrelated jitter requires base > 0 and max delay >= base")
+	}
+	if c.firstHedgeDelay < 0 {
+		return errors.New("hedgedhttp: first hedge delay must be >= 0")
+	}
+	if c.hasDelayOpt("WithExponentialDelay") && (c.expBase < 0 || c.expFactor < 1) {
+		return errors.New("hedgedhttp: exponential delay requires base >= 0 and factor >= 1")
+	}
+	if c.maxHedgeableLen < 0 {
+		return errors.New("hedgedhttp: max hedgeable content length must be >= 0")
+	}
+	if c.maxBufferedBody < 0 {
+		return errors.New("hedgedhttp: max buffered body must be >= 0")
+	}
+	if c.policy < PolicyFirstDone || c.policy > PolicyWaitAll {
+		return errors.New("hedgedhttp: unknown selection policy")
+	}
+	if c.errorAggregation < AggregateAll || c.errorAggregation > LastError {
+		return errors.New("hedgedhttp: unknown error aggregation")
+	}
+	if c.selectorMode < SelectOnFirstReady || c.selectorMode > SelectOnAllDone {
+		return errors.New("hedgedhttp: unknown selector mode")
+	}
+	if c.named && !validName(c.name) {
+		return errors.New("hedgedhttp: name must be non-empty and contain only letters, digits, '_' and '-'")
+	}
+	if c.maxConcurrency < 0 {
+		return errors.New("hedgedhttp: max concurrency must be >= 0")
+	}
+	for _, host := range c.hosts {
+		if host == "" {
+			return errors.New("hedgedhttp: host cannot be empty")
+		}
+	}
+	for _, wh := range c.weightedHosts {
+		if wh.host == "" || wh.weight <= 0 {
+			return errors.New("hedgedhttp: weighted host cannot be empty and its weight must be > 0")
+		}
+	}
+	for _, u := range c.targetURLs {
+		if u == nil || !u.IsAbs() || u.Host == "" {
+			return errors.New("hedgedhttp: target URL must be absolute")
+		}
+	}
+	rotates := len(c.hosts) > 0 || len(c.weightedHosts) > 0
+	if len(c.hosts) > 0 && len(c.weightedHosts) > 0 || rotates && len(c.targetURLs) > 0 {
+		return errors.New("hedgedhttp: options WithHostRotation, WithWeightedHosts, WithTargetURLs are mutually exclusive")
+	}
+	if c.minRemainingBudget < 0 {
+		return errors.New("hedgedhttp: min remaining budget must be >= 0")
+	}
+	if c.totalBudget < 0 {
+		return errors.New("hedgedhttp: total budget must be >= 0")
+	}
+	if c.latencyBudget < 0 {
+		return errors.New("hedgedhttp: latency budget must be >= 0")
+	}
+	if c.perAttemptTimeout < 0 {
+		return errors.New("hedgedhttp: per attempt timeout must be >= 0")
+	}
+	if c.drainLimit < 0 {
+		return errors.New("hedgedhttp: drain limit must be >= 0")
+	}
+	if c.maxDrains < 1 {
+		return errors.New("hedgedhttp: max concurrent drains must be >= 1")
+	}
+	if c.drainTimeout <= 0 {
+		return errors.New("hedgedhttp: drain timeout must be > 0")
+	}
+	if c.loserGrace < 0 {
+		return errors.New("hedgedhttp: loser grace period must be >= 0")
+	}
+	if c.hasDelayOpt("WithAdaptiveDelay") && (c.adaptivePercentile <= 0 || c.adaptivePercentile > 100) {
+		return errors.New("hedgedhttp: adaptive delay percentile must be in (0, 100]")
+	}
+	if c.adaptiveSeed < 0 || c.adaptiveWindow < 0 {
+		return errors.New("hedgedhttp: adaptive seed delay and window must be >= 0")
+	}
+	if c.quorum < 0 || c.quorum > 1 && c.equal == nil {
+		return errors.New("hedgedhttp: quorum must be >= 0 and requires an equality predicate")
+	}
+	if c.quorumBodyLimit < 0 {
+		return errors.New("hedgedhttp: quorum body limit must be >= 0")
+	}
+	if c.triggerOnInvalid && c.validator == nil {
+		return errors.New("hedgedhttp: validation triggered hedging requires a response validator")
+	}
+	if c.jitter < 0 || c.jitter > 1 {
+		return errors.New("hedgedhttp: jitter fraction must be in [0, 1]")
+	}
+	return nil
+}
+
+// validName reports whether the name is safe to use as a metric label value and a log prefix.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addDelayOpt records the delay option, the same option given again only overrides its values.
+func (c *config) addDelayOpt(name string) {
+	if !c.hasDelayOpt(name) {
+		c.delayOpts = append(c.delayOpts, name)
+	}
+}
+
+func (c *config) hasDelayOpt(name string) bool {
+	for _, opt := range c.delayOpts {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func exponentialDelay(base time.Duration, factor float64) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := float64(base) * math.Pow(factor, float64(attempt-1))
+		if d >= float64(infiniteTimeout) {
+			return infiniteTimeout
+		}
+		return time.Duration(d)
+	}
+}
@@ -0,0 +1,135 @@
+package hedgedhttp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// rankUnbuffered is a rank of a response which is too large to take part in the quorum.
+const rankUnbuffered = 1
+
+// vote is a buffered response waiting for a quorum.
+type vote struct {
+	indexedResp
+	body  []byte
+	agree int // number of votes equal to this one, including itself
+}
+
+// resp returns the response with its body rewound, so it can be read again.
+func (v vote) resp() *http.Response {
+	v.Resp.Body = io.NopCloser(bytes.NewReader(v.body))
+	return v.Resp
+}
+
+// vote buffers the response and compares it with previous votes.
+// Reports whether the response is agreed by the quorum, in that case it becomes the winner.
+// Response which is larger than the quorum body limit doesn't vote, it's held as a fallback.
+func (g *hedgeGroup) vote(res indexedResp) (bool, error) {
+	ht := g.ht
+	body := res.Resp.Body
+	buf, err := io.ReadAll(io.LimitReader(body, ht.quorumBodyLimit+1))
+	if err != nil {
+		body.Close()
+		g.endAttempt(res.Index, AttemptFailed, nil, err)
+		return false, err
+	}
+
+	if int64(len(buf)) > ht.quorumBodyLimit {
+		res.Resp.Body = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(buf), body),
+			Closer: body,
+		}
+		var loser candidate
+		g.held, loser = pickCandidate(g.held, candidate{indexedResp: res, rank: rankUnbuffered})
+		g.discard(loser.indexedResp)
+		return false, nil
+	}
+	body.Close()
+
+	v := vote{indexedResp: res, body: buf, agree: 1}
+	for i := range g.votes {
+		if ht.equal(g.votes[i].resp(), v.resp()) {
+			g.votes[i].agree++
+			v.agree++
+		}
+	}
+	g.votes = append(g.votes, v)
+
+	if v.agree < ht.quorum {
+		return false, nil
+	}
+	g.winner = res.Index
+	return true, nil
+}
+
+// bestVote returns the vote agreed by the most responses, the earliest one wins a tie.
+func (g *hedgeGroup) bestVote() (vote, bool) {
+	var best vote
+	for _, v := range g.votes {
+		if v.agree > best.agree {
+			best = v
+		}
+	}
+	return best, best.agree > 0
+}
+
+// DecodedBodyEqual is an equality predicate for WithQuorum which compares response bodies
+// decoded according to their Content-Encoding, so replicas which compress the same payload
+// differently (or don't compress it at all) agree. Supported encodings are gzip and deflate.
+// Responses which cannot be read or decoded are never equal.
+func DecodedBodyEqual(a, b *http.Response) bool {
+	bodyA, err := decodedBody(a)
+	if err != nil {
+		return false
+	}
+	bodyB, err := decodedBody(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(bodyA, bodyB)
+}
+
+// decodedBody reads the response body and removes all content codings in reverse order of application.
+func decodedBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	codings := strings.Split(resp.Header.Get("Content-Encoding"), ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		if body, err = decode(strings.TrimSpace(codings[i]), body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func decode(coding string, body []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(coding) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate must be zlib wrapped, but some servers send raw deflate
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("hedgedhttp: unsupported content encoding %q", coding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
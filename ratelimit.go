@@ -0,0 +1,10 @@
+package hedgedhttp
+
+import "context"
+
+// RateLimiter limits the rate of requests sent by the transport, see WithRateLimiter.
+// *rate.Limiter from golang.org/x/time/rate satisfies this interface.
+type RateLimiter interface {
+	// Wait blocks until a request can be sent or ctx is done, in that case an error is returned.
+	Wait(ctx context.Context) error
+}
@@ -0,0 +1,50 @@
+package hedgedhttp
+
+import (
+	"math"
+	"time"
+)
+
+// RecommendUpto estimates how many requests are needed, so at least one of them finishes
+// within target with the given probability (confidence in (0, 1), e.g. 0.99),
+// based on measured latencies of single requests.
+//
+// Requests are assumed to be independent with the empirical latency distribution
+// and to be sent at the same time (see WithImmediateFanout): the probability that some
+// of n requests is fast enough is 1 - (1-p)^n, where p is the fraction of latencies within target.
+// Requests sent with a delay have less time, so more of them may be needed, and latencies
+// correlated by a slow backend or network make all requests slow, which hedging doesn't help.
+//
+// Returns 0 if the target can't be reached, e.g. no latency is within target or latencies is empty.
+// Returns 1 if confidence is <= 0. It's a planning utility, it doesn't affect any client.
+func RecommendUpto(latencies []time.Duration, target time.Duration, confidence float64) int {
+	if len(latencies) == 0 {
+		return 0
+	}
+	if confidence <= 0 {
+		return 1
+	}
+	fast := 0
+	for _, l := range latencies {
+		if l <= target {
+			fast++
+		}
+	}
+	switch {
+	case fast == len(latencies):
+		return 1
+	case fast == 0 || confidence >= 1:
+		return 0
+	}
+
+	miss := 1 - float64(fast)/float64(len(latencies))
+	// epsilon keeps exact results, e.g. 2 for p = 0.9 and confidence = 0.99, from rounding up
+	n := math.Ceil(math.Log(1-confidence)/math.Log(miss) - 1e-9)
+	if n < 1 {
+		return 1
+	}
+	if n > math.MaxInt32 {
+		return 0
+	}
+	return int(n)
+}
@@ -0,0 +1,61 @@
+package hedgedhttp
+
+import "net/http"
+
+// SelectorMode defines when the response selector is called, see WithResponseSelector.
+type SelectorMode int
+
+const (
+	// SelectOnFirstReady calls the selector as soon as a response which can be returned
+	// has arrived (see WithSelectionPolicy and WithResponseValidator), or when all requests
+	// are finished without such response. This is the default.
+	SelectOnFirstReady SelectorMode = iota
+
+	// SelectOnAllDone calls the selector only when all requests are finished.
+	SelectOnAllDone
+)
+
+// selectResponse calls the response selector with all completed responses,
+// the selected one becomes the winner. Invalid index or no selector selects the best ranked response,
+// of the lowest attempt among equal ranks, so a rejected response is selected only if all are rejected.
+func (g *hedgeGroup) selectResponse() *http.Response {
+	candidates := make([]*http.Response, len(g.completed))
+	best := 0
+	for i, c := range g.completed {
+		candidates[i] = c.Resp
+		if b := g.completed[best]; c.rank < b.rank || c.rank == b.rank && c.Index < b.Index {
+			best = i
+		}
+	}
+
+	idx := best
+	if g.ht.selector != nil {
+		idx = g.ht.selectIndex(candidates)
+	}
+	if idx < 0 || idx >= len(candidates) {
+		idx = best
+	}
+	g.winner = g.completed[idx].Index
+	return candidates[idx]
+}
+
+// SelectLargestContentLength is a response selector which returns the 2xx response
+// with the largest Content-Length, e.g. to skip truncated responses of mirrors.
+// Responses of unknown length (-1) are selected only if there is no 2xx response of known length,
+// among equal lengths the first one wins. If there is no 2xx response, the default response is selected.
+// Use it with WithSelectorMode(SelectOnAllDone) to compare all responses:
+//
+//	hedgedhttp.WithResponseSelector(hedgedhttp.SelectLargestContentLength),
+//	hedgedhttp.WithSelectorMode(hedgedhttp.SelectOnAllDone),
+func SelectLargestContentLength(candidates []*http.Response) int {
+	best := -1
+	for i, resp := range candidates {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			continue
+		}
+		if best == -1 || resp.ContentLength > candidates[best].ContentLength {
+			best = i
+		}
+	}
+	return best
+}
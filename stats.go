@@ -0,0 +1,233 @@
+package hedgedhttp
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// atomicCounter is a false sharing safe counter.
+type atomicCounter struct {
+	count uint64
+	_     [7]uint64
+}
+
+func (c *atomicCounter) inc() { atomic.AddUint64(&c.count, 1) }
+
+func (c *atomicCounter) dec() { atomic.AddUint64(&c.count, ^uint64(0)) }
+
+func (c *atomicCounter) load() uint64 { return atomic.LoadUint64(&c.count) }
+
+func (c *atomicCounter) reset() { atomic.StoreUint64(&c.count, 0) }
+
+type cacheLine [64]byte
+
+// Stats object that can be queried to obtain certain metrics and get better observability.
+// All methods are safe for concurrent use.
+type Stats struct {
+	_                   cacheLine
+	requestedRoundTrips atomicCounter
+	actualRoundTrips    atomicCounter
+	canceledSubRequests atomicCounter
+	adaptiveDelay       atomicCounter
+	failedAttempts      atomicCounter
+	inFlight            atomicCounter
+	regret              atomicCounter
+	_                   cacheLine
+
+	statusCounts        statusCounter
+	firstAttemptLatency latencyWindow
+}
+
+// RequestedRoundTrips returns count of requests that were requested by client.
+func (s *Stats) RequestedRoundTrips() uint64 { return s.requestedRoundTrips.load() }
+
+// ActualRoundTrips returns count of requests that were actually sent.
+func (s *Stats) ActualRoundTrips() uint64 { return s.actualRoundTrips.load() }
+
+// CanceledSubRequests returns count of hedged sub-requests that were canceled by transport.
+func (s *Stats) CanceledSubRequests() uint64 { return s.canceledSubRequests.load() }
+
+// InFlight returns count of requests (including hedged ones) which are sent and waiting for a response.
+func (s *Stats) InFlight() int64 { return int64(s.inFlight.load()) }
+
+// AdaptiveDelay returns the latest hedge delay computed by WithAdaptiveDelay.
+// Returns zero if adaptive delay is not used.
+func (s *Stats) AdaptiveDelay() time.Duration {
+	return time.Duration(s.adaptiveDelay.load())
+}
+
+// FirstAttemptLatencyStats returns minimum, mean and maximum latency of the first requests
+// of the latest round trips which have got a response, see WithAdaptiveSeed for the window size.
+// Returns zeros if no round trip has got a response yet.
+func (s *Stats) FirstAttemptLatencyStats() (min, mean, max time.Duration) {
+	return s.firstAttemptLatency.summary()
+}
+
+// Regret returns count of responses with a better status class than the returned response
+// of their round trip, which have arrived after it was returned, see WithRegretMetric.
+func (s *Stats) Regret() uint64 { return s.regret.load() }
+
+// StatusCounts returns count of requests (including hedged ones) per response status code.
+func (s *Stats) StatusCounts() map[int]uint64 { return s.statusCounts.snapshot() }
+
+// ErrorCount returns count of requests (including hedged ones) that failed without a response.
+// Requests canceled by transport are not counted.
+func (s *Stats) ErrorCount() uint64 { return s.failedAttempts.load() }
+
+// StatsSnapshot is a copy of Stats counters, see Stats.Snapshot.
+type StatsSnapshot struct {
+	RequestedRoundTrips uint64
+	ActualRoundTrips    uint64
+	CanceledSubRequests uint64
+	ErrorCount          uint64
+	StatusCounts        map[int]uint64
+	InFlight            int64
+	AdaptiveDelay       time.Duration
+	Regret              uint64
+}
+
+// Snapshot returns a copy of all counters. Every counter is read atomically, but not all of them
+// at once, so counters may be slightly skewed relative to each other under concurrent requests.
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		RequestedRoundTrips: s.RequestedRoundTrips(),
+		ActualRoundTrips:    s.ActualRoundTrips(),
+		CanceledSubRequests: s.CanceledSubRequests(),
+		ErrorCount:          s.ErrorCount(),
+		StatusCounts:        s.StatusCounts(),
+		InFlight:            s.InFlight(),
+		AdaptiveDelay:       s.AdaptiveDelay(),
+		Regret:              s.Regret(),
+	}
+}
+
+// Reset zeroes all counters. Like Snapshot every counter is reset atomically, but not all of them at once.
+// InFlight and AdaptiveDelay reflect the current state, so they are not reset.
+func (s *Stats) Reset() {
+	s.requestedRoundTrips.reset()
+	s.actualRoundTrips.reset()
+	s.canceledSubRequests.reset()
+	s.failedAttempts.reset()
+	s.statusCounts.reset()
+	s.regret.reset()
+}
+
+func (s *Stats) setAdaptiveDelay(d time.Duration) {
+	atomic.StoreUint64(&s.adaptiveDelay.count, uint64(d))
+}
+
+// statusCounter counts responses per status code.
+type statusCounter struct {
+	mu     sync.Mutex
+	counts map[int]uint64
+}
+
+func (c *statusCounter) inc(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[int]uint64)
+	}
+	c.counts[code]++
+}
+
+func (c *statusCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = nil
+}
+
+func (c *statusCounter) snapshot() map[int]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[int]uint64, len(c.counts))
+	for code, n := range c.counts {
+		counts[code] = n
+	}
+	return counts
+}
+
+const defaultLatencyWindow = 100
+
+// latencyWindow is a ring buffer which keeps the latest latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// init sets the size of the window, samples are kept if the size hasn't changed,
+// so transports sharing the same Stats don't reset each other.
+func (w *latencyWindow) init(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) == size {
+		return
+	}
+	w.samples = make([]time.Duration, size)
+	w.next, w.full = 0, false
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.samples == nil {
+		w.samples = make([]time.Duration, defaultLatencyWindow)
+	}
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next, w.full = 0, true
+	}
+}
+
+// summary returns minimum, mean and maximum of the samples, zeros if there are none.
+func (w *latencyWindow) summary() (min, mean, max time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	samples := w.samples
+	if !w.full {
+		samples = samples[:w.next]
+	}
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+
+	min, max = samples[0], samples[0]
+	var sum time.Duration
+	for _, d := range samples {
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		sum += d
+	}
+	return min, sum / time.Duration(len(samples)), max
+}
+
+// percentile returns the given percentile (in (0, 100]) of the samples,
+// reports false if the window isn't full yet.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if !w.full {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx], true
+}
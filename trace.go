@@ -0,0 +1,110 @@
+package hedgedhttp
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Tracer traces hedged round trips.
+// See github.com/cristalhq/hedgedhttp/hedgedotel for OpenTelemetry implementation.
+type Tracer interface {
+	// Start is called when a round trip starts, returned context is used by all its requests.
+	Start(ctx context.Context, req *http.Request) (context.Context, Span)
+}
+
+// Span traces a single hedged round trip.
+type Span interface {
+	// StartAttempt is called before the request is sent, delay is the time waited since the previous request.
+	StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, AttemptSpan)
+
+	// End is called when the round trip is finished, winner is the index of the returned response or -1.
+	End(winner int, err error)
+}
+
+// AttemptSpan traces a single request of a hedged round trip.
+type AttemptSpan interface {
+	// End is called once when the request outcome is known.
+	End(outcome AttemptOutcome, resp *http.Response, err error)
+}
+
+// AttemptOutcome describes how a request of a hedged round trip has ended.
+type AttemptOutcome int
+
+const (
+	// AttemptWon means the response is returned to the caller.
+	AttemptWon AttemptOutcome = iota
+
+	// AttemptLost means the response is discarded in favor of another one.
+	AttemptLost
+
+	// AttemptFailed means the request has returned an error.
+	AttemptFailed
+
+	// AttemptCanceled means the request was canceled because the round trip has finished.
+	AttemptCanceled
+)
+
+func (o AttemptOutcome) String() string {
+	switch o {
+	case AttemptWon:
+		return "won"
+	case AttemptLost:
+		return "lost"
+	case AttemptFailed:
+		return "failed"
+	case AttemptCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// joinTracers returns a tracer which calls both tracers in order.
+func joinTracers(a, b Tracer) Tracer {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	m, ok := a.(multiTracer)
+	if !ok {
+		m = multiTracer{a}
+	}
+	return append(m, b)
+}
+
+type multiTracer []Tracer
+
+func (m multiTracer) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	spans := make(multiSpan, len(m))
+	for i, t := range m {
+		ctx, spans[i] = t.Start(ctx, req)
+	}
+	return ctx, spans
+}
+
+type multiSpan []Span
+
+func (m multiSpan) StartAttempt(ctx context.Context, attempt int, delay time.Duration) (context.Context, AttemptSpan) {
+	spans := make(multiAttemptSpan, len(m))
+	for i, s := range m {
+		ctx, spans[i] = s.StartAttempt(ctx, attempt, delay)
+	}
+	return ctx, spans
+}
+
+func (m multiSpan) End(winner int, err error) {
+	for _, s := range m {
+		s.End(winner, err)
+	}
+}
+
+type multiAttemptSpan []AttemptSpan
+
+func (m multiAttemptSpan) End(outcome AttemptOutcome, resp *http.Response, err error) {
+	for _, s := range m {
+		s.End(outcome, resp, err)
+	}
+}